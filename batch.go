@@ -0,0 +1,130 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// write batch format:
+// [sequence number][number of records][record]...[record]
+//
+// sequence number: the sequence number of the first record, the next records follow it.
+// It is assigned when the batch is committed.
+// record: as written by encode.
+
+// writeBatchHeaderSize is the size of the header of a serialized write batch.
+const writeBatchHeaderSize = 16
+
+// WriteBatch is a list of updates applied atomically by LSMTree.Write:
+// after a crash either every update of the batch is present or none is.
+// The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	records bytes.Buffer
+	count   int
+}
+
+// Put adds setting the value for the given key to the batch.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.add(key, value, recordTypePut)
+}
+
+// Delete adds removing the given key to the batch.
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(key, nil, recordTypeDelete)
+}
+
+// add appends a record to the batch. Writing to a bytes.Buffer cannot fail.
+func (b *WriteBatch) add(key, value []byte, rt recordType) {
+	encode(&b.records, key, value, rt)
+	b.count++
+}
+
+// Len returns the number of updates in the batch.
+func (b *WriteBatch) Len() int {
+	return b.count
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.records.Reset()
+	b.count = 0
+}
+
+// Data returns the serialized batch, which SetData loads back.
+func (b *WriteBatch) Data() []byte {
+	data := make([]byte, writeBatchHeaderSize, writeBatchHeaderSize+b.records.Len())
+	copy(data[8:], encodeInt(b.count))
+	return append(data, b.records.Bytes()...)
+}
+
+// SetData replaces the content of the batch with the serialized batch data,
+// as returned by Data. Invalid data is reported as an error and leaves the batch unchanged.
+func (b *WriteBatch) SetData(data []byte) error {
+	count := 0
+	err := iterateWriteBatch(data, func(seq uint64, key, value []byte, rt recordType) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("lsmtree: invalid write batch: %w", err)
+	}
+
+	b.Reset()
+	b.records.Write(data[writeBatchHeaderSize:])
+	b.count = count
+	return nil
+}
+
+// writeBatchSequence returns the sequence number of the serialized batch.
+func writeBatchSequence(data []byte) uint64 {
+	return binary.BigEndian.Uint64(data)
+}
+
+// setWriteBatchSequence sets the sequence number of the serialized batch.
+func setWriteBatchSequence(data []byte, seq uint64) {
+	binary.BigEndian.PutUint64(data, seq)
+}
+
+// writeBatchCount returns the number of records of the serialized batch.
+func writeBatchCount(data []byte) int {
+	return decodeInt(data[8:writeBatchHeaderSize])
+}
+
+// iterateWriteBatch calls fn for every record of the serialized batch, in order, with its sequence number.
+// Returns errCorruptRecord if the batch cannot be valid, possibly after calling fn
+// for the records before the corruption.
+func iterateWriteBatch(data []byte, fn func(seq uint64, key, value []byte, rt recordType) error) error {
+	if len(data) < writeBatchHeaderSize {
+		return errCorruptRecord
+	}
+	seq, count := writeBatchSequence(data), writeBatchCount(data)
+	if count < 0 || seq+uint64(count) > maxSequenceNumber {
+		return errCorruptRecord
+	}
+
+	r := bytes.NewReader(data[writeBatchHeaderSize:])
+	for i := 0; i < count; i++ {
+		key, value, rt, err := decode(r)
+		if err != nil {
+			return errCorruptRecord
+		}
+		if err := fn(seq+uint64(i), key, value, rt); err != nil {
+			return err
+		}
+	}
+	if r.Len() > 0 {
+		return errCorruptRecord
+	}
+	return nil
+}
+
+// applyWriteBatch inserts the records of the serialized batch into the memTable.
+// The batch is checked first, nothing is inserted from an invalid batch.
+func applyWriteBatch(mt *memTable, data []byte) error {
+	noop := func(seq uint64, key, value []byte, rt recordType) error { return nil }
+	if err := iterateWriteBatch(data, noop); err != nil {
+		return err
+	}
+	return iterateWriteBatch(data, mt.set)
+}
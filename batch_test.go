@@ -0,0 +1,103 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestWriteBatchData(t *testing.T) {
+	var batch WriteBatch
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Delete([]byte("b"))
+	batch.Put([]byte("c"), nil)
+	if batch.Len() != 3 {
+		t.Fatalf("batch should hold 3 updates, got %d", batch.Len())
+	}
+
+	var loaded WriteBatch
+	if err := loaded.SetData(batch.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 3 || !bytes.Equal(loaded.Data(), batch.Data()) {
+		t.Fatalf("loaded batch should be the same as the batch, got %d updates", loaded.Len())
+	}
+
+	mt := newMemTable()
+	if err := applyWriteBatch(mt, loaded.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if value, ikey, exists := mt.get([]byte("a"), maxSequenceNumber); !exists || internalKeyType(ikey) != recordTypePut || string(value) != "1" {
+		t.Fatalf("a should be 1, got %s", value)
+	}
+	if _, ikey, exists := mt.get([]byte("b"), maxSequenceNumber); !exists || internalKeyType(ikey) != recordTypeDelete {
+		t.Fatal("b should be deleted")
+	}
+	if value, ikey, exists := mt.get([]byte("c"), maxSequenceNumber); !exists || internalKeyType(ikey) != recordTypePut || len(value) != 0 {
+		t.Fatalf("c should be empty, got %s", value)
+	}
+
+	batch.Reset()
+	if batch.Len() != 0 || len(batch.Data()) != writeBatchHeaderSize {
+		t.Fatalf("reset batch should be empty, got %d updates", batch.Len())
+	}
+}
+
+func TestWriteBatchInvalidData(t *testing.T) {
+	var batch WriteBatch
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Put([]byte("b"), []byte("2"))
+	data := batch.Data()
+
+	wrongCount := append([]byte(nil), data...)
+	copy(wrongCount[8:], encodeInt(3))
+	for _, invalid := range [][]byte{nil, data[:4], data[:len(data)-1], append(data, 0), wrongCount} {
+		var loaded WriteBatch
+		loaded.Put([]byte("x"), []byte("y"))
+		if err := loaded.SetData(invalid); err == nil {
+			t.Fatalf("SetData should reject %v", invalid)
+		}
+		if loaded.Len() != 1 {
+			t.Fatalf("rejected data should leave the batch unchanged, got %d updates", loaded.Len())
+		}
+
+		mt := newMemTable()
+		if err := applyWriteBatch(mt, invalid); err == nil || mt.keys != 0 {
+			t.Fatalf("applyWriteBatch should reject %v without inserting, got %v and %d keys", invalid, err, mt.keys)
+		}
+	}
+}
+
+func TestWriteBatchTornWAL(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch WriteBatch
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	if err := tree.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the batch write loses all of it.
+	data := readFile(t, fs, walPath(dir, 0))
+	writeFile(t, fs, walPath(dir, 0), data[:len(data)/2])
+
+	tree, err = Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < 10; i++ {
+		if _, exists, err := tree.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || exists {
+			t.Fatalf("key%d should not exist, got %v %v", i, exists, err)
+		}
+	}
+}
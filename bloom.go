@@ -0,0 +1,104 @@
+package lsmtree
+
+// bloom filter format:
+// [bit array][number of probes, 1 byte]
+
+// maxBloomProbes is the largest number of probes a filter may use.
+// Filters with more probes are treated as matching every key.
+const maxBloomProbes = 30
+
+// bloomFilterBuilder collects the hashes of the keys written to a disk table.
+type bloomFilterBuilder struct {
+	hashes []uint32
+}
+
+// add adds key to the filter.
+func (b *bloomFilterBuilder) add(key []byte) {
+	b.hashes = append(b.hashes, bloomHash(key))
+}
+
+// build returns the filter of the keys added so far, using bitsPerKey bits per key.
+func (b *bloomFilterBuilder) build(bitsPerKey int) []byte {
+	// 0.69 is about ln(2), the number of probes minimizing the false positive rate.
+	probes := bitsPerKey * 69 / 100
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > maxBloomProbes {
+		probes = maxBloomProbes
+	}
+
+	// Tiny filters have a high false positive rate, use at least 64 bits.
+	bits := len(b.hashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	filter := make([]byte, bytes+1)
+	filter[bytes] = byte(probes)
+	for _, h := range b.hashes {
+		// Double hashing: every probe adds delta to the hash.
+		delta := h>>17 | h<<15
+		for i := 0; i < probes; i++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// bloomFilterMayContain returns false if key is surely not in the filter.
+// Empty or unknown filters match every key.
+func bloomFilterMayContain(filter []byte, key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+
+	bits := uint32(len(filter)-1) * 8
+	probes := int(filter[len(filter)-1])
+	if probes > maxBloomProbes {
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < probes; i++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// bloomHash is a murmur-like hash of key.
+func bloomHash(key []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+
+	h := uint32(seed) ^ uint32(len(key))*m
+	for ; len(key) >= 4; key = key[4:] {
+		h += uint32(key[0]) | uint32(key[1])<<8 | uint32(key[2])<<16 | uint32(key[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(key) {
+	case 3:
+		h += uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(key[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
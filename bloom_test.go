@@ -0,0 +1,111 @@
+package lsmtree
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// falsePositiveRate builds a filter of keyNum keys and returns the rate of absent keys it matches.
+func falsePositiveRate(t *testing.T, keyNum, bitsPerKey int) float64 {
+	var b bloomFilterBuilder
+	for i := 0; i < keyNum; i++ {
+		b.add([]byte(fmt.Sprintf("key%d", i)))
+	}
+	filter := b.build(bitsPerKey)
+
+	for i := 0; i < keyNum; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if !bloomFilterMayContain(filter, key) {
+			t.Fatalf("filter should contain %s", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < keyNum; i++ {
+		if bloomFilterMayContain(filter, []byte(fmt.Sprintf("absent%d", i))) {
+			falsePositives++
+		}
+	}
+	return float64(falsePositives) / float64(keyNum)
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	for _, c := range []struct {
+		bitsPerKey int
+		maxRate    float64
+	}{
+		{bitsPerKey: 4, maxRate: 0.2},
+		{bitsPerKey: 10, maxRate: 0.02},
+		{bitsPerKey: 20, maxRate: 0.001},
+	} {
+		rate := falsePositiveRate(t, 10000, c.bitsPerKey)
+		t.Logf("%d bits per key: %.4f false positives", c.bitsPerKey, rate)
+		if rate > c.maxRate {
+			t.Errorf("%d bits per key should have at most %.4f false positives, got %.4f", c.bitsPerKey, c.maxRate, rate)
+		}
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	var b bloomFilterBuilder
+	filter := b.build(10)
+	if bloomFilterMayContain(filter, []byte("key")) {
+		t.Fatal("empty filter should not contain any key")
+	}
+	if !bloomFilterMayContain(nil, []byte("key")) {
+		t.Fatal("missing filter should match every key")
+	}
+}
+
+func TestGetChecksFilter(t *testing.T) {
+	fs := &countingFS{FS: NewMemFS()}
+	opts := &Options{MemTableSize: 1024, L0CompactionTrigger: 100, Sync: SyncNever, FS: fs}
+	tree, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filters are read back on Open.
+	tree, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get reads a data block of every disk table its filter does not rule out.
+	tree.mu.RLock()
+	tables := tree.levels[0]
+	tree.mu.RUnlock()
+	if len(tables) < 2 {
+		t.Fatalf("there should be several disk tables, got %d", len(tables))
+	}
+
+	const lookups = 1000
+	read := 0
+	for i := 0; i < lookups; i++ {
+		reads := atomic.LoadInt32(&fs.reads)
+		// Absent keys inside the key range of every disk table.
+		if _, _, err := tree.Get([]byte(fmt.Sprintf("key%04d.", i))); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&fs.reads) != reads {
+			read++
+		}
+	}
+	t.Logf("%d of %d lookups of absent keys read a disk table", read, lookups)
+	if read > lookups/20 {
+		t.Fatalf("bloom filters should rule out most absent keys, %d of %d lookups read a disk table", read, lookups)
+	}
+}
@@ -0,0 +1,41 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumSize is the size of an encoded checksum.
+const checksumSize = 4
+
+// crcTable is the CRC32C (Castagnoli) table used by all checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC32C of b.
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, crcTable)
+}
+
+// ErrCorruption is matched by every CorruptionError, use errors.Is to test for it.
+var ErrCorruption = errors.New("lsmtree: corruption")
+
+// CorruptionError reports corrupted data in a file of the database,
+// such as a checksum mismatch in the WAL or in a disk table.
+type CorruptionError struct {
+	// Path is the file holding the corrupted data.
+	Path string
+	// Offset is the offset of the corrupted record or block in the file.
+	Offset int64
+	// Reason tells what is wrong with the data.
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("lsmtree: corruption in %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// Is reports whether target is ErrCorruption.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
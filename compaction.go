@@ -0,0 +1,330 @@
+package lsmtree
+
+import "bytes"
+
+// compaction merges disk tables of a level with the overlapping disk tables of the output level.
+type compaction struct {
+	level       int
+	outputLevel int
+	// inputs are the disk tables from level and outputLevel.
+	// inputs[0] is newest first for L0, inputs[1] is sorted by key.
+	// When outputLevel is L0, inputs[0] are adjacent disk tables and inputs[1] is empty.
+	inputs [2][]*tableMeta
+	// maxOutputSize is the size at which output disk tables are split, 0 writes a single disk table.
+	maxOutputSize int
+}
+
+// manualCompaction is a CompactRange request handled by the compaction goroutine.
+type manualCompaction struct {
+	start, end []byte
+	done       chan error
+}
+
+// CompactRange flushes the memTable and compacts every disk table holding keys in [start, end].
+// LeveledCompactionPicker compacts them down to the deepest level holding keys in that range,
+// SizeTieredCompactionPicker merges them with every older disk table.
+// A nil start or end leaves the range unbounded.
+// It returns once the compactions are installed.
+func (t *LSMTree) CompactRange(start, end []byte) error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+
+	mc := &manualCompaction{start: start, end: end, done: make(chan error, 1)}
+
+	t.mu.Lock()
+	for t.manualCompaction != nil && !t.closing && t.bgErr == nil {
+		t.bgCond.Wait()
+	}
+	if t.closing {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	if t.bgErr != nil {
+		err := t.bgErr
+		t.mu.Unlock()
+		return err
+	}
+	t.manualCompaction = mc
+	t.bgCond.Broadcast()
+	t.mu.Unlock()
+
+	return <-mc.done
+}
+
+// WaitForCompactions waits until the background goroutines have nothing left to do:
+// no immutable memTable waits for flush, no compaction is needed and none is running.
+func (t *LSMTree) WaitForCompactions() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for !t.closing && t.bgErr == nil &&
+		(len(t.immMemTables) > 0 || t.compacting || t.manualCompaction != nil || t.needsCompaction()) {
+		t.bgCond.Wait()
+	}
+	if t.closing {
+		return ErrClosed
+	}
+	return t.bgErr
+}
+
+// needsCompaction reports whether the compaction picker has work to do. mu must be held.
+func (t *LSMTree) needsCompaction() bool {
+	return t.opts.CompactionPicker.pickCompaction(t) != nil
+}
+
+// compactionLoop runs compactions in the background whenever the compaction picker has work
+// or a CompactRange is requested. It stops at the first error, which is then returned to writers.
+func (t *LSMTree) compactionLoop() {
+	defer t.bgWG.Done()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		for !t.closing && t.bgErr == nil && t.manualCompaction == nil && !t.needsCompaction() {
+			t.bgCond.Wait()
+		}
+		if t.closing || t.bgErr != nil {
+			if mc := t.manualCompaction; mc != nil {
+				t.manualCompaction = nil
+				mc.done <- ErrClosed
+			}
+			return
+		}
+
+		mc := t.manualCompaction
+		c := t.opts.CompactionPicker.pickCompaction(t)
+		t.compacting = true
+		t.mu.Unlock()
+
+		var err error
+		if mc != nil {
+			err = t.opts.CompactionPicker.compactRange(t, mc.start, mc.end)
+		} else if c != nil {
+			err = t.runCompaction(c)
+		}
+
+		t.mu.Lock()
+		t.compacting = false
+		if mc != nil {
+			t.manualCompaction = nil
+			mc.done <- err
+		}
+		if err != nil {
+			t.opts.Logger.Printf("lsmtree: background compaction failed: %s", err)
+			t.bgErr = err
+		}
+		t.bgCond.Broadcast()
+	}
+}
+
+// runCompaction merges the inputs into new disk tables of the output level and installs them.
+// A single input table with nothing to merge with is moved to the output level as is.
+// Otherwise all inputs are merged in one pass.
+func (t *LSMTree) runCompaction(c *compaction) error {
+	t.diskTableMu.Lock()
+	defer t.diskTableMu.Unlock()
+
+	if c.level != c.outputLevel && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		t.opts.Logger.Printf("lsmtree: moving disk table %d from L%d to L%d", c.inputs[0][0].index, c.level, c.outputLevel)
+		return t.installCompaction(c, c.inputs[0])
+	}
+
+	// sources are ordered from newest to oldest. Tables of the output level do not
+	// overlap each other, so their relative order does not matter.
+	var sources []int
+	for _, table := range c.inputs[0] {
+		sources = append(sources, table.index)
+	}
+	for _, table := range c.inputs[1] {
+		sources = append(sources, table.index)
+	}
+	t.opts.Logger.Printf("lsmtree: compacting %d disk tables from L%d and %d from L%d", len(c.inputs[0]), c.level, len(c.inputs[1]), c.outputLevel)
+
+	// Snapshots taken later see the newest version of every key of the inputs.
+	t.mu.RLock()
+	levels := t.levels
+	snapshots := t.snapshotSequences()
+	t.mu.RUnlock()
+	out := &compactionWriter{
+		t:       t,
+		maxSize: c.maxOutputSize,
+		dropTombstone: func(key []byte) bool {
+			return !c.olderTablesHold(levels, key)
+		},
+		oldestSnapshot: maxSequenceNumber,
+	}
+	if len(snapshots) > 0 {
+		out.oldestSnapshot = snapshots[0]
+	}
+
+	if err := mergeDiskTables(t.fs, t.dbDir, sources, snapshots, out); err != nil {
+		out.abort()
+		return err
+	}
+	if err := out.finish(); err != nil {
+		out.abort()
+		return err
+	}
+
+	return t.installCompaction(c, out.outputs)
+}
+
+// olderTablesHold reports whether a disk table older than the inputs may hold key.
+// The levels must be taken after the inputs were picked.
+func (c *compaction) olderTablesHold(levels [numLevels][]*tableMeta, key []byte) bool {
+	level := c.outputLevel + 1
+	if c.outputLevel == 0 {
+		oldest := c.inputs[0][len(c.inputs[0])-1]
+		older := false
+		for _, table := range levels[0] {
+			if older && table.overlaps(key, key) {
+				return true
+			}
+			if table == oldest {
+				older = true
+			}
+		}
+		level = 1
+	}
+
+	for ; level < numLevels; level++ {
+		if findTable(levels[level], key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// installCompaction replaces the inputs with the outputs in the output level by appending one
+// version edit to the MANIFEST, then deletes the input files that are not part of the outputs.
+// Once the edit is appended, failing to delete an input is logged, not returned.
+// Outputs to L0 take the place of the inputs, their sequence numbers keep L0 newest first.
+func (t *LSMTree) installCompaction(c *compaction, outputs []*tableMeta) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ve := &versionEdit{logNumber: t.logNumber}
+	for i, inputs := range c.inputs {
+		level := c.level
+		if i == 1 {
+			level = c.outputLevel
+		}
+		for _, table := range inputs {
+			ve.deleteTable(level, table)
+		}
+	}
+	for _, table := range outputs {
+		ve.addTable(c.outputLevel, table)
+	}
+	crashPoint(t.fs, "compaction: installing")
+	if err := t.logAndApply(ve); err != nil {
+		return err
+	}
+	crashPoint(t.fs, "compaction: installed")
+	t.compactedBytes += totalSize(removeTables(outputs, c.inputs[0]))
+
+	if c.level > 0 {
+		_, largest := keyRange(c.inputs[0])
+		t.compactPointers[c.level] = largest
+	}
+
+	// An input left behind is removed as obsolete by the next Open.
+	for _, inputs := range c.inputs {
+		for _, table := range removeTables(inputs, outputs) {
+			if err := deleteDiskTable(t.fs, t.dbDir, table.index); err != nil {
+				t.opts.Logger.Printf("lsmtree: removing compacted disk table %d: %s", table.index, err)
+				continue
+			}
+			crashPoint(t.fs, "compaction: input deleted")
+		}
+	}
+	return nil
+}
+
+// newDiskTableIndex allocates the index of a new disk table.
+func (t *LSMTree) newDiskTableIndex() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.nextDiskTableIndex
+	t.nextDiskTableIndex++
+	return index
+}
+
+// compactionWriter writes the output of a compaction to disk tables of about maxSize bytes.
+// The versions of a key are never split between disk tables.
+// Tombstones are dropped when every snapshot sees them and no older disk table may hold the key.
+type compactionWriter struct {
+	t             *LSMTree
+	maxSize       int
+	dropTombstone func(key []byte) bool
+	// oldestSnapshot is the sequence number of the oldest open snapshot, maxSequenceNumber if there is none.
+	oldestSnapshot uint64
+
+	writer  *sstWriter
+	index   int
+	outputs []*tableMeta
+}
+
+// write the record of the internal key with its value and record type to the current output disk table.
+func (cw *compactionWriter) write(key, value []byte, rt recordType) error {
+	userKey := extractUserKey(key)
+	if rt == recordTypeDelete && internalKeySequence(key) <= cw.oldestSnapshot && cw.dropTombstone(userKey) {
+		return nil
+	}
+
+	if cw.writer != nil && cw.maxSize > 0 && cw.writer.size() >= cw.maxSize && !bytes.Equal(userKey, cw.writer.largest) {
+		if err := cw.finish(); err != nil {
+			return err
+		}
+	}
+	if cw.writer == nil {
+		cw.index = cw.t.newDiskTableIndex()
+		writer, err := newSSTWriter(cw.t.fs, diskTablePath(cw.t.dbDir, cw.index), cw.t.opts.BlockSize, cw.t.opts.BloomBitsPerKey)
+		if err != nil {
+			return err
+		}
+		cw.writer = writer
+		crashPoint(cw.t.fs, "compaction: output created")
+	}
+
+	return cw.writer.write(key, value, rt)
+}
+
+// finish syncs and closes the current output disk table, then opens it for reading.
+func (cw *compactionWriter) finish() error {
+	if cw.writer == nil {
+		return nil
+	}
+
+	writer := cw.writer
+	cw.writer = nil
+	if err := writer.sync(); err != nil {
+		writer.close()
+		return err
+	}
+	if err := writer.close(); err != nil {
+		return err
+	}
+
+	table := writer.meta(cw.index)
+	cw.outputs = append(cw.outputs, table)
+	crashPoint(cw.t.fs, "compaction: output written")
+	return openDiskTable(cw.t.fs, cw.t.dbDir, table, !cw.t.opts.DisableChecksumVerification)
+}
+
+// abort closes and deletes every output disk table.
+func (cw *compactionWriter) abort() {
+	if cw.writer != nil {
+		cw.writer.close()
+		cw.outputs = append(cw.outputs, &tableMeta{index: cw.index})
+		cw.writer = nil
+	}
+	closeDiskTables(cw.outputs)
+	for _, table := range cw.outputs {
+		deleteDiskTable(cw.t.fs, cw.t.dbDir, table.index)
+	}
+	cw.outputs = nil
+}
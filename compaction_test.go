@@ -0,0 +1,358 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func levelTableNumShouldBe(t *testing.T, tree *LSMTree, level, want int) {
+	tree.mu.RLock()
+	got := len(tree.levels[level])
+	tree.mu.RUnlock()
+	if got != want {
+		t.Fatalf("L%d should have %d disk tables, got %d", level, want, got)
+	}
+}
+
+// levelsShouldBeSorted checks that the disk tables of every level above L0 are sorted and do not overlap.
+func levelsShouldBeSorted(t *testing.T, tree *LSMTree) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	for level := 1; level < numLevels; level++ {
+		tables := tree.levels[level]
+		for i := 1; i < len(tables); i++ {
+			if bytes.Compare(tables[i-1].largest, tables[i].smallest) >= 0 {
+				t.Fatalf("L%d disk tables %d [%s, %s] and %d [%s, %s] overlap", level,
+					tables[i-1].index, tables[i-1].smallest, tables[i-1].largest,
+					tables[i].index, tables[i].smallest, tables[i].largest)
+			}
+		}
+	}
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 64, L0CompactionTrigger: 3, BlockSize: 32, Sync: SyncNever, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("%03d", i%50))
+		if err := tree.Put(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.WaitForCompactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.mu.RLock()
+	l0 := len(tree.levels[0])
+	tree.mu.RUnlock()
+	if l0 >= 3 {
+		t.Fatalf("background compaction should keep less than 3 L0 disk tables, got %d", l0)
+	}
+	levelsShouldBeSorted(t, tree)
+
+	for i := 150; i < 200; i++ {
+		key := []byte(fmt.Sprintf("%03d", i%50))
+		value, exists, err := tree.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || string(value) != fmt.Sprintf("%d", i) {
+			t.Fatalf("Get failed: key %s should be %d, got %s", key, i, value)
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	opts := &Options{
+		MemTableSize:        256,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       1024,
+		LevelSizeMultiplier: 2,
+		TargetFileSize:      256,
+		BlockSize:           32,
+		Sync:                SyncNever,
+		FS:                  fs,
+	}
+	tree, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keyNum = 500
+	for i := 0; i < 3*keyNum; i++ {
+		key := []byte(fmt.Sprintf("%04d", (i*7)%keyNum))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keyNum; i += 10 {
+		if err := tree.Delete([]byte(fmt.Sprintf("%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.WaitForCompactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.mu.RLock()
+	deepest := 0
+	for level := range tree.levels {
+		if len(tree.levels[level]) > 0 {
+			deepest = level
+		}
+	}
+	tree.mu.RUnlock()
+	if deepest < 2 {
+		t.Fatalf("compactions should reach L2, deepest level is L%d", deepest)
+	}
+	levelsShouldBeSorted(t, tree)
+
+	check := func(tree *LSMTree) {
+		for i := 2 * keyNum; i < 3*keyNum; i++ {
+			n := (i * 7) % keyNum
+			key := []byte(fmt.Sprintf("%04d", n))
+			value, exists, err := tree.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n%10 == 0 {
+				if exists {
+					t.Fatalf("Get failed: key %s should be deleted, got %s", key, value)
+				}
+				continue
+			}
+			if !exists || string(value) != fmt.Sprintf("value%d", i) {
+				t.Fatalf("Get failed: key %s should be value%d, got %s", key, i, value)
+			}
+		}
+	}
+	check(tree)
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check(tree)
+}
+
+func TestCompactRange(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{L0CompactionTrigger: 10, BlockSize: 32, Sync: SyncNever, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// One disk table per pair of keys: [a, b], [c, d], [e, f], [g, h].
+	for _, pair := range [][2]string{{"a", "b"}, {"c", "d"}, {"e", "f"}, {"g", "h"}} {
+		for _, key := range pair {
+			if err := tree.Put([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	levelTableNumShouldBe(t, tree, 0, 4)
+
+	// Nothing overlaps, nothing to compact.
+	if err := tree.CompactRange([]byte("x"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	levelTableNumShouldBe(t, tree, 0, 4)
+
+	// L0 disk tables may overlap, all of them are compacted together.
+	if err := tree.CompactRange([]byte("c"), []byte("cc")); err != nil {
+		t.Fatal(err)
+	}
+	levelTableNumShouldBe(t, tree, 0, 0)
+	levelTableNumShouldBe(t, tree, 1, 1)
+
+	// The tombstone is dropped since no deeper level holds the key.
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	levelTableNumShouldBe(t, tree, 0, 0)
+	levelTableNumShouldBe(t, tree, 1, 1)
+
+	tree.mu.RLock()
+	smallest := string(tree.levels[1][0].smallest)
+	tree.mu.RUnlock()
+	if smallest != "b" {
+		t.Fatalf("L1 should start at b, got %s", smallest)
+	}
+
+	for _, key := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		value, exists, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || string(value) != key {
+			t.Fatalf("Get failed: key %s should be %s, got %s", key, key, value)
+		}
+	}
+	if _, exists, err := tree.Get([]byte("a")); err != nil || exists {
+		t.Fatalf("Get failed: key a should be deleted, got %v %v", exists, err)
+	}
+
+	if err := tree.WaitForCompactions(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeAmplification writes the same keys with the given compaction picker
+// and returns the bytes written to disk tables per byte flushed.
+// Every batch is flushed and compacted before the next one, so the result does not depend on timing.
+func writeAmplification(t *testing.T, picker CompactionPicker) float64 {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{
+		MemTableSize:        1 << 20,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       2048,
+		LevelSizeMultiplier: 4,
+		TargetFileSize:      1024,
+		CompactionPicker:    picker,
+		BlockSize:           256,
+		Sync:                SyncNever,
+		FS:                  fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keyNum, batchSize = 1000, 40
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", (i*37)%keyNum))
+	}
+	for i := 0; i < keyNum; i++ {
+		if err := tree.Put(key(i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if (i+1)%batchSize != 0 {
+			continue
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.WaitForCompactions(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < keyNum; i++ {
+		value, exists, err := tree.Get(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Get failed: key %s should be value%d, got %s", key(i), i, value)
+		}
+	}
+
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return float64(tree.flushedBytes+tree.compactedBytes) / float64(tree.flushedBytes)
+}
+
+func TestCompactionPickerWriteAmplification(t *testing.T) {
+	leveled := writeAmplification(t, &LeveledCompactionPicker{})
+	sizeTiered := writeAmplification(t, &SizeTieredCompactionPicker{})
+	t.Logf("write amplification: leveled %.2f, size-tiered %.2f", leveled, sizeTiered)
+	if sizeTiered >= leveled {
+		t.Fatalf("size-tiered compaction should write less than leveled compaction, got %.2f >= %.2f", sizeTiered, leveled)
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{
+		MemTableSize:     64,
+		CompactionPicker: &SizeTieredCompactionPicker{MinMergeWidth: 3},
+		Sync:             SyncNever,
+		FS:               fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("%03d", i%100))
+		if err := tree.Put(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := tree.Delete([]byte(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.WaitForCompactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.mu.RLock()
+	for level := 1; level < numLevels; level++ {
+		if len(tree.levels[level]) > 0 {
+			t.Fatalf("size-tiered compaction should keep every disk table in L0, L%d has %d", level, len(tree.levels[level]))
+		}
+	}
+	runs := len(tree.levels[0])
+	tree.mu.RUnlock()
+	if runs > 10 {
+		t.Fatalf("size-tiered compaction should merge similarly sized disk tables, got %d in L0", runs)
+	}
+
+	check := func() {
+		for i := 200; i < 300; i++ {
+			key := []byte(fmt.Sprintf("%03d", i%100))
+			value, exists, err := tree.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 0 {
+				if exists {
+					t.Fatalf("Get failed: key %s should be deleted, got %s", key, value)
+				}
+				continue
+			}
+			if !exists || string(value) != fmt.Sprintf("%d", i) {
+				t.Fatalf("Get failed: key %s should be %d, got %s", key, i, value)
+			}
+		}
+	}
+	check()
+
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	levelTableNumShouldBe(t, tree, 0, 1)
+	check()
+}
@@ -1,336 +1,254 @@
 package lsmtree
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"os"
 	"path"
+	"sort"
 	"strconv"
 )
 
 const (
-	// diskTableDataFileName is the name of the file that contains the data.
-	diskTableDataFileNamePrefix = "data.dat"
-	// diskTableIndexFileName is the name of the file that contains the index of data.
-	diskTableIndexFileNamePrefix = "index.dat"
-	// diskTableSparseIndexFileName is the name of the file that contains the sparse index of index.
-	diskTableSparseIndexFileNamePrefix = "sparseindex.dat"
+	// diskTableFileNameSuffix is the suffix of the sstable file of a diskTable.
+	diskTableFileNameSuffix = ".sst"
 )
 
-// createDiskTable creates a new diskTable for given memTable.
-// prefx is the prefix of the file names.
-func createDiskTable(mt *memTable, dir string, index, sparseKeyDistance int) error {
-	// prefix of the database file
-	prefix := strconv.Itoa(index) + "_"
+// diskTablePath returns the path of the sstable file of the diskTable for giving diskTable index.
+func diskTablePath(dir string, index int) string {
+	return path.Join(dir, strconv.Itoa(index)+diskTableFileNameSuffix)
+}
 
-	writer, err := newDiskTableWriter(dir, prefix, sparseKeyDistance)
+// createDiskTable creates a new diskTable for given memTable.
+// Returns the description of the new diskTable.
+func createDiskTable(fs FS, mt *memTable, dir string, index, blockSize, bloomBitsPerKey int) (*tableMeta, error) {
+	writer, err := newSSTWriter(fs, diskTablePath(dir, index), blockSize, bloomBitsPerKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	mti := mt.iterator()
-	for mti.hasNext() {
-		key, value, err := mti.next()
+	for mti.valid() {
+		err := writer.write(mti.key(), mti.value(), mti.recordType())
 		if err != nil {
-			return err
+			writer.close()
+			return nil, err
 		}
 
-		err = writer.write(key, value)
-		if err != nil {
-			return err
+		if err := mti.next(); err != nil {
+			writer.close()
+			return nil, err
 		}
 	}
 
 	if err := writer.sync(); err != nil {
-		return err
+		writer.close()
+		return nil, err
 	}
 
 	if err := writer.close(); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return writer.meta(index), nil
 }
 
-// searchDiskTable search the key-value in diskTable for giving diskTable index.
-func searchDiskTable(dir string, index int, key []byte) ([]byte, bool, error) {
-	// prefix of the database file
-	prefix := strconv.Itoa(index) + "_"
-
-	sparseIndexPath := path.Join(dir, prefix+diskTableSparseIndexFileNamePrefix)
-	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_RDONLY, 0600)
-	if err != nil {
-		return nil, false, err
-	}
-	defer sparseIndexFile.Close()
-
-	from, to, exists, err := searchSparseIndex(sparseIndexFile, key)
-	if err != nil {
-		return nil, false, err
-	}
-	if !exists {
-		return nil, false, nil
-	}
-
-	fmt.Printf("searchSparseIndex: key %s, from %x, to %x, exists %t\n", string(key), from, to, exists)
-
-	indexPath := path.Join(dir, prefix+diskTableIndexFileNamePrefix)
-	indexFile, err := os.OpenFile(indexPath, os.O_RDONLY, 0600)
-	if err != nil {
-		return nil, false, err
-	}
-	defer indexFile.Close()
-	offset, exists, err := searchIndexFile(indexFile, key, from, to)
-	if err != nil {
-		return nil, false, err
-	}
-	if !exists {
-		return nil, false, nil
-	}
-
-	fmt.Printf("searchIndexFile: key %s, exists %t, offset %x\n", string(key), exists, offset)
-
-	dataPath := path.Join(dir, prefix+diskTableDataFileNamePrefix)
-	dataFile, err := os.OpenFile(dataPath, os.O_RDONLY, 0600)
+// openDiskTable opens the sstable of the diskTable, its reader is kept in the table.
+// The bloom filter is read if the table does not have it yet.
+// Data blocks are verified against their checksum if verify is true.
+func openDiskTable(fs FS, dir string, table *tableMeta, verify bool) error {
+	reader, err := openSSTReader(fs, diskTablePath(dir, table.index), verify)
 	if err != nil {
-		return nil, false, err
+		return err
 	}
-	defer dataFile.Close()
-	value, err := searchDataFile(dataFile, key, offset)
-	if err != nil {
-		return nil, false, err
+	if table.filter == nil {
+		if table.filter, err = reader.readFilter(); err != nil {
+			reader.close()
+			return err
+		}
 	}
-
-	fmt.Printf("searchDataFile: key %s, value %s\n", string(key), string(value))
-
-	return value, true, nil
+	table.reader = reader
+	return nil
 }
 
-// searchSparseIndex search the key in sparseIndexFile.
-// Return false if key not found.
-// [from, to) interval is the range of key in indexFile.
-func searchSparseIndex(r io.Reader, key []byte) (int, int, bool, error) {
-	from := -1
-	for {
-		sparseKey, value, err := decode(r)
-		if err != nil && err != io.EOF {
-			return 0, 0, false, err
-		}
-		if err == io.EOF {
-			return from, 0, true, nil
-		}
-
-		if bytes.Compare(key, sparseKey) < 0 {
-			if from == -1 {
-				// key less than first sparseKey
-				return 0, 0, false, nil
-			}
-			return from, int(decodeInt(value)), true, nil
-		} else if bytes.Equal(key, sparseKey) {
-			return int(decodeInt(value)), int(decodeInt(value)), true, nil
-		} else {
-			from = int(decodeInt(value))
+// closeDiskTables closes the readers of the disk tables, for disk tables never installed.
+func closeDiskTables(tables []*tableMeta) {
+	for _, table := range tables {
+		if table.reader != nil {
+			table.reader.close()
 		}
 	}
 }
 
-// searchIndexFile search the key in indexFile.
-// Return false if key not found.
-// Return offset in dataFile.
-func searchIndexFile(r io.ReadSeeker, key []byte, from, to int) (int, bool, error) {
-	if _, err := r.Seek(int64(from), io.SeekStart); err != nil {
-		return 0, false, err
-	}
-
-	for {
-		indexKey, value, err := decode(r)
-		if err != nil && err != io.EOF {
-			return 0, false, err
-		}
-		if err == io.EOF {
-			// already reach the end of the file
-			return 0, false, nil
-		}
-		offset := decodeInt(value)
-
-		if bytes.Equal(key, indexKey) {
-			return offset, true, nil
+// searchDiskTables searches the disk tables in order for the newest version of key visible at
+// the sequence number, then releases them. Returns the value and the internal key of the first
+// version found, tombstones are reported as found.
+func searchDiskTables(tables []*tableMeta, key []byte, seq uint64) ([]byte, []byte, bool, error) {
+	defer func() {
+		for _, table := range tables {
+			table.unref()
 		}
+	}()
 
-		if to > from {
-			current, err := r.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return 0, false, err
-			}
-
-			if current > int64(to) {
-				// already reach the uppper bound
-				return 0, false, nil
-			}
+	for _, table := range tables {
+		value, ikey, exists, err := table.reader.get(key, seq)
+		if err != nil || exists {
+			return value, ikey, exists, err
 		}
 	}
+	return nil, nil, false, nil
 }
 
-// searchDataFile search the key in dataFile at giving offset.
-// Return false if key not found.
-// Return value if key found.
-func searchDataFile(r io.ReadSeeker, key []byte, offset int) ([]byte, error) {
-	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	dataKey, value, err := decode(r)
-	if err != nil {
-		return nil, err
-	}
-	if !bytes.Equal(key, dataKey) {
-		return nil, nil
-	}
-
-	return value, nil
+// deleteDiskTable deletes the sstable file of the diskTable.
+func deleteDiskTable(fs FS, dir string, index int) error {
+	return fs.Remove(diskTablePath(dir, index))
 }
 
-type diskTableWriter struct {
-	dataFile        *os.File
-	indexFile       *os.File
-	sparseIndexFile *os.File
-
-	sparseKeyDistance int
-
-	// Position of the last byte written to the data file.
-	keyNum, dataPos, indexPos int
+// diskTableIterator is an iterator over a diskTable.
+// It keeps the data block at the current position decoded in memory.
+type diskTableIterator struct {
+	reader *sstReader
+	// table is the diskTable whose shared reader is used, released on close.
+	// It is nil if the iterator opened its own reader.
+	table *tableMeta
+
+	// block is the position of the current data block in the index, entries its records
+	// and entry the current record in entries.
+	block   int
+	entries []blockEntry
+	entry   int
+	ok      bool
 }
 
-// newDiskTableWriter create write for writing diskTable
-func newDiskTableWriter(dir, prefix string, sparseKeyDistance int) (*diskTableWriter, error) {
-	dataPath := path.Join(dir, prefix+diskTableDataFileNamePrefix)
-	dataFile, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+// newDiskTableIterator opens the diskTable for giving diskTable index.
+// The iterator is not positioned until one of the seek methods is called.
+// Data blocks are verified against their checksum if verify is true.
+func newDiskTableIterator(fs FS, dir string, index int, verify bool) (*diskTableIterator, error) {
+	reader, err := openSSTReader(fs, diskTablePath(dir, index), verify)
 	if err != nil {
-		return nil, fmt.Errorf("createDiskTableWriter: failed to open data file %s: %s", dataPath, err)
+		return nil, err
 	}
+	return &diskTableIterator{reader: reader}, nil
+}
 
-	indexPath := path.Join(dir, prefix+diskTableIndexFileNamePrefix)
-	indexFile, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("createDiskTableWriter: failed to open index file %s: %s", indexPath, err)
-	}
+// newTableIterator returns an iterator over the diskTable using its shared reader.
+// The table must be referenced, the reference is released on close.
+func newTableIterator(table *tableMeta) *diskTableIterator {
+	return &diskTableIterator{reader: table.reader, table: table}
+}
 
-	sparseIndexPath := path.Join(dir, prefix+diskTableSparseIndexFileNamePrefix)
-	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("createDiskTableWriter: failed to open sparse index file %s: %s", sparseIndexPath, err)
+// seek moves the iterator to the first internal key greater than or equal to key.
+func (dti *diskTableIterator) seek(key []byte) error {
+	if err := dti.loadBlock(dti.reader.findBlock(key)); err != nil || !dti.ok {
+		return err
 	}
 
-	writer := &diskTableWriter{
-		dataFile:        dataFile,
-		indexFile:       indexFile,
-		sparseIndexFile: sparseIndexFile,
-
-		sparseKeyDistance: sparseKeyDistance,
-
-		keyNum:   0,
-		dataPos:  0,
-		indexPos: 0,
-	}
-	return writer, nil
+	// The last key of the block is greater than or equal to key, the entry exists.
+	dti.entry = sort.Search(len(dti.entries), func(i int) bool {
+		return compareInternalKeys(dti.entries[i].key, key) >= 0
+	})
+	return nil
 }
 
-// write the key-value to diskTable using diskTableWriter.
-func (writer *diskTableWriter) write(key, value []byte) error {
-	dataBytes, err := encode(writer.dataFile, key, value)
-	if err != nil {
-		return err
+// seekForPrev moves the iterator to the last internal key less than or equal to key.
+func (dti *diskTableIterator) seekForPrev(key []byte) error {
+	block := dti.reader.findBlock(key)
+	if block == len(dti.reader.index) {
+		return dti.seekToLast()
 	}
-
-	indexBytes, err := encode(writer.indexFile, key, encodeInt(writer.dataPos))
-	if err != nil {
+	if err := dti.loadBlock(block); err != nil {
 		return err
 	}
 
-	if writer.keyNum%writer.sparseKeyDistance == 0 {
-		_, err := encode(writer.sparseIndexFile, key, encodeInt(writer.indexPos))
-		if err != nil {
-			return err
-		}
+	dti.entry = sort.Search(len(dti.entries), func(i int) bool {
+		return compareInternalKeys(dti.entries[i].key, key) > 0
+	}) - 1
+	if dti.entry < 0 {
+		return dti.prevBlock()
 	}
-
-	writer.keyNum++
-	writer.dataPos += dataBytes
-	writer.indexPos += indexBytes
 	return nil
 }
 
-// sync diskTableWriter to disk
-func (writer *diskTableWriter) sync() error {
-	if err := writer.dataFile.Sync(); err != nil {
+// seekToLast moves the iterator to the last key in the diskTable.
+func (dti *diskTableIterator) seekToLast() error {
+	if err := dti.loadBlock(len(dti.reader.index) - 1); err != nil {
 		return err
 	}
+	dti.entry = len(dti.entries) - 1
+	return nil
+}
 
-	if err := writer.indexFile.Sync(); err != nil {
-		return err
+// next moves the iterator to the next key-value pair.
+func (dti *diskTableIterator) next() error {
+	dti.entry++
+	if dti.entry < len(dti.entries) {
+		return nil
 	}
-
-	if err := writer.sparseIndexFile.Sync(); err != nil {
+	if err := dti.loadBlock(dti.block + 1); err != nil {
 		return err
 	}
+	dti.entry = 0
 	return nil
 }
 
-// close closes diskTableWriter all three files
-func (writer *diskTableWriter) close() error {
-	if err := writer.dataFile.Close(); err != nil {
-		return err
-	}
-
-	if err := writer.indexFile.Close(); err != nil {
-		return err
+// prev moves the iterator to the previous key-value pair.
+func (dti *diskTableIterator) prev() error {
+	dti.entry--
+	if dti.entry >= 0 {
+		return nil
 	}
+	return dti.prevBlock()
+}
 
-	if err := writer.sparseIndexFile.Close(); err != nil {
+// prevBlock moves the iterator to the last key-value pair of the previous data block.
+func (dti *diskTableIterator) prevBlock() error {
+	if err := dti.loadBlock(dti.block - 1); err != nil {
 		return err
 	}
+	dti.entry = len(dti.entries) - 1
 	return nil
 }
 
-// deleteDiskTables delete all diskTable files
-func deleteDiskTables(dir, prefix string) error {
-	dataPath := path.Join(dir, prefix+diskTableDataFileNamePrefix)
-	if err := os.Remove(dataPath); err != nil {
-		return err
+// loadBlock reads the data block at position block in the index.
+// The iterator is invalid if there is no such block.
+func (dti *diskTableIterator) loadBlock(block int) error {
+	dti.block = block
+	dti.entries = nil
+	dti.ok = false
+	if block < 0 || block >= len(dti.reader.index) {
+		return nil
 	}
 
-	indexPath := path.Join(dir, prefix+diskTableIndexFileNamePrefix)
-	if err := os.Remove(indexPath); err != nil {
+	entries, err := dti.reader.readDataBlock(block)
+	if err != nil {
 		return err
 	}
+	dti.entries = entries
+	dti.ok = true
+	return nil
+}
 
-	sparseIndexPath := path.Join(dir, prefix+diskTableSparseIndexFileNamePrefix)
-	if err := os.Remove(sparseIndexPath); err != nil {
-		return err
-	}
+// valid returns true if the iterator is positioned at a key-value pair.
+func (dti *diskTableIterator) valid() bool {
+	return dti.ok
+}
 
-	return nil
+// key returns the internal key at the current position.
+func (dti *diskTableIterator) key() []byte {
+	return dti.entries[dti.entry].key
 }
 
-// renameDiskTables rename all three diskTable files
-func renameDiskTables(dir, from, to string) error {
-	dataPathFrom := path.Join(dir, from+diskTableDataFileNamePrefix)
-	dataPathTo := path.Join(dir, to+diskTableDataFileNamePrefix)
-	if err := os.Rename(dataPathFrom, dataPathTo); err != nil {
-		return err
-	}
+// value returns the value at the current position, <nil> for tombstones.
+func (dti *diskTableIterator) value() []byte {
+	return dti.entries[dti.entry].value
+}
 
-	indexPathFrom := path.Join(dir, from+diskTableIndexFileNamePrefix)
-	indexPathTo := path.Join(dir, to+diskTableIndexFileNamePrefix)
-	if err := os.Rename(indexPathFrom, indexPathTo); err != nil {
-		return err
-	}
+// recordType returns the record type at the current position.
+func (dti *diskTableIterator) recordType() recordType {
+	return dti.entries[dti.entry].rt
+}
 
-	sparseIndexPathFrom := path.Join(dir, from+diskTableSparseIndexFileNamePrefix)
-	sparseIndexPathTo := path.Join(dir, to+diskTableSparseIndexFileNamePrefix)
-	if err := os.Rename(sparseIndexPathFrom, sparseIndexPathTo); err != nil {
-		return err
+// close closes the sstable file of the diskTable, or releases the diskTable for a shared reader.
+func (dti *diskTableIterator) close() error {
+	if dti.table != nil {
+		return dti.table.unref()
 	}
-	return nil
+	return dti.reader.close()
 }
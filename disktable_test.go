@@ -0,0 +1,163 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiskTableIteratorPrev(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+
+	mt := newMemTable()
+	keys := []string{"01", "03", "05", "07", "09", "11", "13"}
+	for i, key := range keys {
+		mt.put(uint64(i+1), []byte(key), []byte("v"+key))
+	}
+	table, err := createDiskTable(fs, mt, dir, 0, 16, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(table.smallest) != keys[0] || string(table.largest) != keys[len(keys)-1] {
+		t.Fatalf("disk table should hold [%s, %s], got [%s, %s]", keys[0], keys[len(keys)-1], table.smallest, table.largest)
+	}
+
+	dti, err := newDiskTableIterator(fs, dir, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dti.close()
+
+	if err := dti.seekToLast(); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !dti.valid() || string(extractUserKey(dti.key())) != keys[i] {
+			t.Fatalf("prev failed: should be positioned at %s", keys[i])
+		}
+		if string(dti.value()) != "v"+keys[i] {
+			t.Fatalf("prev failed: value of %s is %s", keys[i], dti.value())
+		}
+		if err := dti.prev(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dti.valid() {
+		t.Fatalf("prev failed: should be exhausted, got %s", extractUserKey(dti.key()))
+	}
+
+	if err := dti.seekForPrev(seekKey([]byte("08"), maxSequenceNumber)); err != nil {
+		t.Fatal(err)
+	}
+	if !dti.valid() || string(extractUserKey(dti.key())) != "07" {
+		t.Fatalf("seekForPrev failed: should be positioned at 07")
+	}
+	if err := dti.next(); err != nil {
+		t.Fatal(err)
+	}
+	if !dti.valid() || string(extractUserKey(dti.key())) != "09" {
+		t.Fatalf("next failed: should be positioned at 09")
+	}
+	if err := dti.seekForPrev(seekKey([]byte("00"), maxSequenceNumber)); err != nil {
+		t.Fatal(err)
+	}
+	if dti.valid() {
+		t.Fatalf("seekForPrev failed: should be exhausted, got %s", extractUserKey(dti.key()))
+	}
+}
+
+// countingFS is a FS counting the files opened for reading and the reads at an offset.
+type countingFS struct {
+	FS
+	opens, reads int32
+}
+
+func (fs *countingFS) Open(name string) (File, error) {
+	atomic.AddInt32(&fs.opens, 1)
+	f, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, fs: fs}, nil
+}
+
+// countingFile is a file opened by a countingFS.
+type countingFile struct {
+	File
+	fs *countingFS
+}
+
+func (f *countingFile) ReadAt(p []byte, offset int64) (int, error) {
+	atomic.AddInt32(&f.fs.reads, 1)
+	return f.File.ReadAt(p, offset)
+}
+
+func TestDiskTableReaders(t *testing.T) {
+	fs := &countingFS{FS: NewMemFS()}
+	tree, err := Open("db", &Options{FS: fs, L0CompactionTrigger: 4, BlockSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1", "2"} {
+		if err := tree.Put([]byte("a"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reads use the readers opened by the flushes.
+	opens := atomic.LoadInt32(&fs.opens)
+	for i := 0; i < 10; i++ {
+		valueShouldBe(t, tree, "a", "2")
+	}
+	it, err := tree.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&fs.opens); got != opens {
+		t.Fatalf("reads should not open disk tables, %d were opened", got-opens)
+	}
+
+	// The iterator keeps the compacted disk tables open until it is closed.
+	tree.mu.RLock()
+	compacted := tree.levels[0]
+	tree.mu.RUnlock()
+	if len(compacted) != 2 {
+		t.Fatalf("L0 should hold 2 disk tables, got %d", len(compacted))
+	}
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Valid() || string(it.Value()) != "2" {
+		t.Fatalf("iterator should read a as 2 after the compaction")
+	}
+	for _, table := range compacted {
+		if refs := atomic.LoadInt32(&table.refs); refs != 1 {
+			t.Fatalf("compacted disk table %d should be referenced by the iterator only, got %d references", table.index, refs)
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range compacted {
+		if !table.reader.file.(*countingFile).File.(*memFile).closed {
+			t.Fatalf("compacted disk table %d should be closed with the iterator", table.index)
+		}
+	}
+
+	tree.mu.RLock()
+	live := tree.levels[1]
+	tree.mu.RUnlock()
+	if len(live) != 1 {
+		t.Fatalf("L1 should hold 1 disk table, got %d", len(live))
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range live {
+		if !table.reader.file.(*countingFile).File.(*memFile).closed {
+			t.Fatalf("disk table %d should be closed by Close", table.index)
+		}
+	}
+}
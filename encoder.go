@@ -2,21 +2,45 @@ package lsmtree
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
+// maxFieldLen is the largest key or value length accepted by decode.
+// Larger lengths can only come from corrupted data.
+const maxFieldLen = 1 << 30
+
+// errCorruptRecord is returned by decode when a record cannot be valid.
+var errCorruptRecord = errors.New("lsmtree: corrupt record")
+
+// recordType tells whether an encoded record stores a value or a deletion.
+type recordType byte
+
+const (
+	// recordTypeDelete marks a tombstone. Its value is always empty.
+	recordTypeDelete recordType = iota
+	// recordTypePut marks a live Key-Value pair.
+	recordTypePut
+)
+
 // encoding format:
-// [key length][key][value length][value]
+// [record type][key length][key][value length][value]
 
-// encode encodes the Key-Value pair and uses the witer to write.
+// encode encodes the Key-Value pair with its record type and uses the witer to write.
 // Returns the number of bytes written and error if any.
-func encode(w io.Writer, key, value []byte) (int, error) {
+func encode(w io.Writer, key, value []byte, rt recordType) (int, error) {
 	// numbers of bytes written
 	bytes := 0
 
 	keyLenEncoded := encodeInt(len(key))
 	valueLenEncoded := encodeInt(len(value))
 
+	if n, err := w.Write([]byte{byte(rt)}); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
 	if n, err := w.Write(keyLenEncoded); err != nil {
 		return n, err
 	} else {
@@ -45,42 +69,59 @@ func encode(w io.Writer, key, value []byte) (int, error) {
 }
 
 // decode decodes the Key-Value pair and uses the reader to read.
-// Returns Key-Value pair and error if any.
-// Value is nil if deleted
-func decode(r io.Reader) ([]byte, []byte, error) {
+// Returns Key-Value pair, record type and error if any.
+// Value is nil for tombstones and empty for puts of an empty value.
+func decode(r io.Reader) ([]byte, []byte, recordType, error) {
+	var rtEncoded [1]byte
 	var keyLenEncoded [8]byte
 	var valueLenEncoded [8]byte
 
+	if _, err := r.Read(rtEncoded[:]); err != nil {
+		return nil, nil, 0, err
+	}
+
+	rt := recordType(rtEncoded[0])
+	if rt != recordTypePut && rt != recordTypeDelete {
+		return nil, nil, 0, errCorruptRecord
+	}
+
 	if _, err := r.Read(keyLenEncoded[:]); err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	keyLen := decodeInt(keyLenEncoded[:])
+	if keyLen < 0 || keyLen > maxFieldLen {
+		return nil, nil, 0, errCorruptRecord
+	}
 	key := make([]byte, keyLen)
 
 	if n, err := r.Read(key); err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	} else if n < keyLen {
-		return nil, nil, io.ErrUnexpectedEOF
+		return nil, nil, 0, io.ErrUnexpectedEOF
 	}
 
 	if _, err := r.Read(valueLenEncoded[:]); err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	valueLen := decodeInt(valueLenEncoded[:])
+	if valueLen < 0 || valueLen > maxFieldLen {
+		return nil, nil, 0, errCorruptRecord
+	}
 	value := make([]byte, valueLen)
 
-	if n, err := r.Read(value); err != nil {
-		return nil, nil, err
+	if n, err := r.Read(value); err != nil && valueLen > 0 {
+		return nil, nil, 0, err
 	} else if n < valueLen {
-		return nil, nil, io.ErrUnexpectedEOF
-	} else if n == 0 {
-		// deleted
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if rt == recordTypeDelete && valueLen == 0 {
 		value = nil
 	}
 
-	return key, value, nil
+	return key, value, rt, nil
 }
 
 // encodeInt encodes the int to slice of bytes.
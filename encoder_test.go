@@ -10,15 +10,15 @@ func TestEncodePut(t *testing.T) {
 	key := []byte("key")
 	value := []byte("value")
 
-	n, err := encode(&buffer, key, value)
+	n, err := encode(&buffer, key, value, recordTypePut)
 	if err != nil {
 		t.Errorf("encode failed: %s", err)
 	}
-	if n != len(key)+len(value)+2*8 {
+	if n != 1+len(key)+len(value)+2*8 {
 		t.Errorf("encode length not correct: %s", err)
 	}
 
-	keyDecoded, valueDecoded, err := decode(&buffer)
+	keyDecoded, valueDecoded, rt, err := decode(&buffer)
 	if err != nil {
 		t.Errorf("decode failed: %s", err)
 	}
@@ -28,6 +28,9 @@ func TestEncodePut(t *testing.T) {
 	if !bytes.Equal(value, valueDecoded) {
 		t.Errorf("decode value not correct: %s", err)
 	}
+	if rt != recordTypePut {
+		t.Errorf("decode record type not correct: %d", rt)
+	}
 	t.Logf("key: %s, value: %s", keyDecoded, valueDecoded)
 }
 
@@ -35,15 +38,15 @@ func TestEncodeDelete(t *testing.T) {
 	buffer := bytes.Buffer{}
 	key := []byte("key")
 
-	n, err := encode(&buffer, key, nil)
+	n, err := encode(&buffer, key, nil, recordTypeDelete)
 	if err != nil {
 		t.Errorf("encode failed: %s", err)
 	}
-	if n != len(key)+2*8 {
+	if n != 1+len(key)+2*8 {
 		t.Errorf("encode length not correct: %s", err)
 	}
 
-	keyDecoded, valueDecoded, err := decode(&buffer)
+	keyDecoded, valueDecoded, rt, err := decode(&buffer)
 	if err != nil {
 		t.Errorf("decode failed: %s", err)
 	}
@@ -53,9 +56,32 @@ func TestEncodeDelete(t *testing.T) {
 	if valueDecoded != nil {
 		t.Errorf("decode value not correct: %s", err)
 	}
+	if rt != recordTypeDelete {
+		t.Errorf("decode record type not correct: %d", rt)
+	}
 	t.Logf("key: %s, value: %s", keyDecoded, valueDecoded)
 }
 
+func TestEncodeEmptyValue(t *testing.T) {
+	buffer := bytes.Buffer{}
+	key := []byte("key")
+
+	if _, err := encode(&buffer, key, []byte{}, recordTypePut); err != nil {
+		t.Errorf("encode failed: %s", err)
+	}
+
+	_, valueDecoded, rt, err := decode(&buffer)
+	if err != nil {
+		t.Errorf("decode failed: %s", err)
+	}
+	if rt != recordTypePut {
+		t.Errorf("empty value decoded as record type %d", rt)
+	}
+	if valueDecoded == nil || len(valueDecoded) != 0 {
+		t.Errorf("decode value not correct: %q", valueDecoded)
+	}
+}
+
 func TestEncodeInt(t *testing.T) {
 	testInt := 233333
 	if decodeInt(encodeInt(testInt)) != testInt {
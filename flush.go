@@ -0,0 +1,81 @@
+package lsmtree
+
+// flushLoop writes the immutable memTables to disk tables, oldest first.
+// It drains the remaining immutable memTables before exiting on Close
+// and stops at the first error, which is then returned to writers.
+func (t *LSMTree) flushLoop() {
+	defer t.bgWG.Done()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		for len(t.immMemTables) == 0 && !t.closing {
+			t.bgCond.Wait()
+		}
+		if len(t.immMemTables) == 0 {
+			return
+		}
+
+		mt := t.immMemTables[0]
+		t.mu.Unlock()
+		err := t.flushMemTable(mt)
+		t.mu.Lock()
+
+		if err != nil {
+			t.opts.Logger.Printf("lsmtree: background flush failed: %s", err)
+			t.bgErr = err
+			t.bgCond.Broadcast()
+			return
+		}
+	}
+}
+
+// flushMemTable writes the oldest immutable memTable to a new L0 disk table.
+// The disk table and the removal of the memTable are installed together,
+// so readers find the keys in exactly one of them. The WAL segment of the
+// memTable is deleted once the MANIFEST no longer needs it.
+func (t *LSMTree) flushMemTable(mt *memTable) error {
+	t.diskTableMu.Lock()
+	defer t.diskTableMu.Unlock()
+
+	index := t.newDiskTableIndex()
+
+	t.opts.Logger.Printf("lsmtree: flushing %d keys to disk table %d", mt.keys, index)
+	table, err := createDiskTable(t.fs, mt, t.dbDir, index, t.opts.BlockSize, t.opts.BloomBitsPerKey)
+	if err != nil {
+		return err
+	}
+	if err := openDiskTable(t.fs, t.dbDir, table, !t.opts.DisableChecksumVerification); err != nil {
+		return err
+	}
+
+	crashPoint(t.fs, "flush: disk table written")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The WAL segments before the one of the next memTable are not needed anymore.
+	logNumber := t.memTable.walNumber
+	if len(t.immMemTables) > 1 {
+		logNumber = t.immMemTables[1].walNumber
+	}
+
+	ve := &versionEdit{logNumber: logNumber}
+	ve.addTable(0, table)
+	if err := t.logAndApply(ve); err != nil {
+		closeDiskTables([]*tableMeta{table})
+		return err
+	}
+
+	t.flushedBytes += table.size
+	t.immMemTables = t.immMemTables[1:]
+	t.bgCond.Broadcast()
+	crashPoint(t.fs, "flush: installed")
+
+	// A segment left behind is removed by the next Open, which skips segments before the log number.
+	if err := deleteWAL(t.fs, t.dbDir, mt.walNumber); err != nil {
+		t.opts.Logger.Printf("lsmtree: removing flushed WAL segment %d: %s", mt.walNumber, err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package lsmtree
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackgroundFlushStall(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 8, MaxImmutableMemTables: 1, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// Hold the disk tables so the background flush cannot make progress.
+	tree.diskTableMu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			tree.diskTableMu.Unlock()
+		}
+	}()
+
+	// Fill the memTable twice: the first one is frozen, the second one stays mutable.
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := tree.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree.mu.RLock()
+	imm := len(tree.immMemTables)
+	tree.mu.RUnlock()
+	if imm != 1 {
+		t.Fatalf("there should be 1 immutable memTable, got %d", imm)
+	}
+
+	// Frozen keys stay readable.
+	value, exists, err := tree.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || string(value) != "v" {
+		t.Fatalf("Get failed: key a should be readable from the immutable memTable")
+	}
+
+	stalled := make(chan error)
+	go func() {
+		stalled <- tree.Put([]byte("i"), []byte("v"))
+	}()
+
+	select {
+	case err := <-stalled:
+		t.Fatalf("Put should stall while the immutable memTable is waiting, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tree.diskTableMu.Unlock()
+	locked = false
+	if err := <-stalled; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tree.mu.RLock()
+	imm = len(tree.immMemTables)
+	tree.mu.RUnlock()
+	if imm != 0 {
+		t.Fatalf("Flush should leave 0 immutable memTables, got %d", imm)
+	}
+
+	for _, key := range []string{"a", "e", "i"} {
+		_, exists, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("Get failed: key %s should exist after flush", key)
+		}
+	}
+}
+
+// walNumbersShouldBe checks the WAL segments left in dir.
+func walNumbersShouldBe(t *testing.T, fs FS, dir string, want ...int) {
+	t.Helper()
+	numbers, err := listWALs(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(numbers) != fmt.Sprint(want) {
+		t.Fatalf("WAL segments should be %v, got %v", want, numbers)
+	}
+}
+
+func TestWALRotation(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walNumbersShouldBe(t, fs, dir, 0)
+
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flushing the memTable starts a new segment and deletes the flushed one.
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	walNumbersShouldBe(t, fs, dir, 1)
+	if err := tree.Put([]byte("key10"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the unflushed segment is replayed.
+	tree, err = Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.memTable.keys != 1 || tree.memTable.walNumber != 1 {
+		t.Fatalf("memTable should hold 1 key of WAL segment 1, got %d keys of segment %d", tree.memTable.keys, tree.memTable.walNumber)
+	}
+	for i := 0; i <= 10; i++ {
+		if _, exists, err := tree.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || !exists {
+			t.Fatalf("key%d should exist, got %v %v", i, exists, err)
+		}
+	}
+}
+
+func TestRecoverWALSegments(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+
+	// Three segments left by a crash before any flush, the newest record of key wins.
+	for number := 0; number < 3; number++ {
+		wal, err := createWAL(fs, dir, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appendWALRecord(wal, []byte("key"), []byte(fmt.Sprintf("value%d", number)), recordTypePut, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendWALRecord(wal, []byte(fmt.Sprintf("key%d", number)), []byte("value"), recordTypePut, false); err != nil {
+			t.Fatal(err)
+		}
+		wal.Close()
+	}
+
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if value, exists, err := tree.Get([]byte("key")); err != nil || string(value) != "value2" {
+		t.Fatalf("key should be value2, got %s %v %v", value, exists, err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	walNumbersShouldBe(t, fs, dir, 3)
+	for _, key := range []string{"key0", "key1", "key2"} {
+		if _, exists, err := tree.Get([]byte(key)); err != nil || !exists {
+			t.Fatalf("%s should exist, got %v %v", key, exists, err)
+		}
+	}
+	if value, _, err := tree.Get([]byte("key")); err != nil || string(value) != "value2" {
+		t.Fatalf("key should be value2 after flush, got %s %v", value, err)
+	}
+}
@@ -0,0 +1,134 @@
+package lsmtree
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrLocked is returned by Open when the database is already open, in this process or another one.
+var ErrLocked = errors.New("lsmtree: database is locked")
+
+// File is an open file of a FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	// Name returns the name the file was opened with.
+	Name() string
+	// Stat returns the description of the file.
+	Stat() (os.FileInfo, error)
+	// Sync commits the content of the file to stable storage.
+	Sync() error
+	// Truncate changes the size of the file, the offset is not moved.
+	Truncate(size int64) error
+}
+
+// FS is the file system holding the files of a database.
+// Missing files are reported by errors satisfying os.IsNotExist.
+type FS interface {
+	// Create creates the named file for reading and writing, truncating it if it exists.
+	Create(name string) (File, error)
+	// Open opens the named file for reading.
+	Open(name string) (File, error)
+	// OpenReadWrite opens the existing named file for reading and writing, at offset 0.
+	OpenReadWrite(name string) (File, error)
+	// Rename renames a file, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	// Remove removes the named file.
+	Remove(name string) error
+	// List returns the names of the entries of the directory, sorted.
+	List(dir string) ([]string, error)
+	// MkdirAll creates the directory and its missing parents.
+	MkdirAll(dir string) error
+	// SyncDir commits the creations, renames and removals of files in the directory to stable storage.
+	SyncDir(dir string) error
+	// Lock takes an exclusive lock on the named file, creating it if needed.
+	// It returns ErrLocked if the lock is already held. Closing the returned io.Closer releases it.
+	Lock(name string) (io.Closer, error)
+}
+
+// OSFS is the FS of the operating system, used by default.
+var OSFS FS = osFS{}
+
+// osFS implements FS with the os package.
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenReadWrite(name string) (File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) List(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock.
+	return f, nil
+}
@@ -0,0 +1,216 @@
+package lsmtree
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// readFile returns the content of the named file of the FS.
+func readFile(t *testing.T, fs FS, name string) []byte {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeFile replaces the content of the named file of the FS.
+func writeFile(t *testing.T, fs FS, name string, data []byte) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fs   FS
+		dir  string
+	}{
+		{"OSFS", OSFS, t.TempDir()},
+		{"MemFS", NewMemFS(), "/tmp/lsmtree"},
+	} {
+		fs, dir := test.fs, path.Join(test.dir, "db")
+		if err := fs.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		name := path.Join(dir, "a")
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("hello world")); err != nil {
+			t.Fatal(err)
+		}
+		// Truncate does not move the offset, writes go on from there.
+		if err := f.Truncate(5); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(5, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("!")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := f.Stat(); err != nil || info.Size() != 6 {
+			t.Fatalf("%s: size should be 6, got %v %v", test.name, info, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if n, err := r.ReadAt(buf, 2); n != 4 || string(buf) != "llo!" {
+			t.Fatalf("%s: ReadAt should read llo!, got %q %v", test.name, buf[:n], err)
+		}
+		if _, err := r.Write([]byte("x")); err == nil {
+			t.Fatalf("%s: writing a file opened for reading should fail", test.name)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fs.Rename(name, path.Join(dir, "b")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Open(name); !os.IsNotExist(err) {
+			t.Fatalf("%s: renamed file should not exist, got %v", test.name, err)
+		}
+		if got := readFile(t, fs, path.Join(dir, "b")); string(got) != "hello!" {
+			t.Fatalf("%s: renamed file should hold hello!, got %q", test.name, got)
+		}
+		rw, err := fs.OpenReadWrite(path.Join(dir, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rw.Write([]byte("j")); err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, fs, path.Join(dir, "b")); string(got) != "jello!" {
+			t.Fatalf("%s: file should hold jello!, got %q", test.name, got)
+		}
+
+		writeFile(t, fs, path.Join(dir, "c"), nil)
+		if err := fs.MkdirAll(path.Join(dir, "sub")); err != nil {
+			t.Fatal(err)
+		}
+		if names, err := fs.List(dir); err != nil || strings.Join(names, ",") != "b,c,sub" {
+			t.Fatalf("%s: directory should hold b,c,sub, got %v %v", test.name, names, err)
+		}
+		if err := fs.Remove(path.Join(dir, "c")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Remove(path.Join(dir, "c")); !os.IsNotExist(err) {
+			t.Fatalf("%s: removing a missing file should fail with a not exist error, got %v", test.name, err)
+		}
+		if err := fs.SyncDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Create(path.Join(dir, "missing", "d")); err == nil {
+			t.Fatalf("%s: creating a file in a missing directory should fail", test.name)
+		}
+
+		lock, err := fs.Lock(path.Join(dir, "LOCK"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Lock(path.Join(dir, "LOCK")); !errors.Is(err, ErrLocked) {
+			t.Fatalf("%s: second Lock should fail with ErrLocked, got %v", test.name, err)
+		}
+		if err := lock.Close(); err != nil {
+			t.Fatal(err)
+		}
+		lock, err = fs.Lock(path.Join(dir, "LOCK"))
+		if err != nil {
+			t.Fatalf("%s: released lock should be taken again, got %v", test.name, err)
+		}
+		lock.Close()
+	}
+}
+
+func TestMemFSCrashClone(t *testing.T) {
+	fs := NewMemFS()
+	f, err := fs.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("synced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" lost")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "b", []byte("b"))
+
+	clone := fs.CrashClone()
+	if got := readFile(t, clone, "a"); string(got) != "synced" {
+		t.Fatalf("crash should keep the synced content, got %q", got)
+	}
+	if got := readFile(t, fs, "a"); string(got) != "synced lost" {
+		t.Fatalf("the original should keep every write, got %q", got)
+	}
+
+	// The clone is independent of the original.
+	writeFile(t, clone, "b", []byte("changed"))
+	if got := readFile(t, fs, "b"); string(got) != "b" {
+		t.Fatalf("writes to the clone should not change the original, got %q", got)
+	}
+	f.Close()
+}
+
+func TestOpenLocked(t *testing.T) {
+	opts := &Options{FS: NewMemFS()}
+	tree, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("db", opts); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Open should fail with ErrLocked, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Open after Close should succeed, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
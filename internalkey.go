@@ -0,0 +1,86 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// internal key format:
+// [user key][trailer]
+//
+// trailer: 8 bytes, the sequence number in the high 56 bits and the record type in the low 8 bits.
+//
+// Every record in the memTable and in the disk tables is stored under its internal key.
+// Internal keys are ordered by user key, then by decreasing sequence number,
+// so the newest version of a user key comes first.
+
+const (
+	// internalKeyTrailerSize is the size of the trailer of an internal key.
+	internalKeyTrailerSize = 8
+
+	// maxSequenceNumber is the largest sequence number that fits in the trailer.
+	maxSequenceNumber = 1<<56 - 1
+
+	// recordTypeForSeek is the record type of the internal keys built for seeking.
+	// It is the largest record type, so it sorts first among the records of the same sequence number.
+	recordTypeForSeek = recordTypePut
+)
+
+// makeInternalKey returns the internal key of the user key written with the sequence number and record type.
+func makeInternalKey(userKey []byte, seq uint64, rt recordType) []byte {
+	ikey := make([]byte, len(userKey)+internalKeyTrailerSize)
+	copy(ikey, userKey)
+	binary.BigEndian.PutUint64(ikey[len(userKey):], seq<<8|uint64(rt))
+	return ikey
+}
+
+// seekKey returns the internal key sorting before every record of the user key
+// visible at the sequence number.
+func seekKey(userKey []byte, seq uint64) []byte {
+	return makeInternalKey(userKey, seq, recordTypeForSeek)
+}
+
+// extractUserKey returns the user key of the internal key.
+func extractUserKey(ikey []byte) []byte {
+	return ikey[:len(ikey)-internalKeyTrailerSize]
+}
+
+// internalKeyTrailer returns the trailer of the internal key.
+func internalKeyTrailer(ikey []byte) uint64 {
+	return binary.BigEndian.Uint64(ikey[len(ikey)-internalKeyTrailerSize:])
+}
+
+// internalKeySequence returns the sequence number of the internal key.
+func internalKeySequence(ikey []byte) uint64 {
+	return internalKeyTrailer(ikey) >> 8
+}
+
+// internalKeyType returns the record type of the internal key.
+func internalKeyType(ikey []byte) recordType {
+	return recordType(internalKeyTrailer(ikey) & 0xff)
+}
+
+// validInternalKey reports whether the key can be an internal key.
+func validInternalKey(ikey []byte) bool {
+	if len(ikey) < internalKeyTrailerSize {
+		return false
+	}
+	rt := internalKeyType(ikey)
+	return rt == recordTypeDelete || rt == recordTypePut
+}
+
+// compareInternalKeys orders internal keys by user key, then by decreasing trailer.
+// It returns -1, 0 or +1 like bytes.Compare.
+func compareInternalKeys(a, b []byte) int {
+	if cmp := bytes.Compare(extractUserKey(a), extractUserKey(b)); cmp != 0 {
+		return cmp
+	}
+	ta, tb := internalKeyTrailer(a), internalKeyTrailer(b)
+	switch {
+	case ta > tb:
+		return -1
+	case ta < tb:
+		return +1
+	}
+	return 0
+}
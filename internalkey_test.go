@@ -0,0 +1,44 @@
+package lsmtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInternalKey(t *testing.T) {
+	ikey := makeInternalKey([]byte("key"), 42, recordTypeDelete)
+	if !validInternalKey(ikey) {
+		t.Fatal("internal key should be valid")
+	}
+	if !bytes.Equal(extractUserKey(ikey), []byte("key")) || internalKeySequence(ikey) != 42 || internalKeyType(ikey) != recordTypeDelete {
+		t.Fatalf("internal key should be key, 42, delete, got %s, %d, %d",
+			extractUserKey(ikey), internalKeySequence(ikey), internalKeyType(ikey))
+	}
+	if validInternalKey([]byte("short")) || validInternalKey(makeInternalKey(nil, 1, recordType(7))) {
+		t.Fatal("internal key should be invalid")
+	}
+
+	// Ordered by user key, then newest first.
+	ordered := [][]byte{
+		seekKey([]byte("a"), maxSequenceNumber),
+		makeInternalKey([]byte("a"), 9, recordTypePut),
+		makeInternalKey([]byte("a"), 9, recordTypeDelete),
+		makeInternalKey([]byte("a"), 1, recordTypePut),
+		makeInternalKey([]byte("a"), 0, recordTypeDelete),
+		makeInternalKey([]byte("a\x00"), 100, recordTypePut),
+		makeInternalKey([]byte("b"), 100, recordTypePut),
+	}
+	for i := range ordered {
+		for j := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = +1
+			}
+			if got := compareInternalKeys(ordered[i], ordered[j]); got != want {
+				t.Fatalf("compare %x and %x should be %d, got %d", ordered[i], ordered[j], want, got)
+			}
+		}
+	}
+}
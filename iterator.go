@@ -0,0 +1,192 @@
+package lsmtree
+
+import (
+	"bytes"
+)
+
+// internalIterator is an iterator over one source of records sorted by internal key,
+// such as the memTable or a diskTable. Every version of a key is reported, tombstones are not hidden.
+type internalIterator interface {
+	seek(key []byte) error
+	seekForPrev(key []byte) error
+	seekToLast() error
+	next() error
+	prev() error
+	valid() bool
+	key() []byte
+	value() []byte
+	recordType() recordType
+	close() error
+}
+
+// Iterator iterates over the key-value pairs in [start, end) in ascending key order,
+// or in descending key order for a reverse Iterator.
+// It merges the memTables with every disk table, the newest value of a key wins
+// and deleted keys are skipped. Writes made after the Iterator is created are not seen.
+// An Iterator must not be used from several goroutines at once.
+type Iterator struct {
+	start, end []byte
+	reverse    bool
+
+	merged *mergingIterator
+
+	key, value []byte
+	valid      bool
+}
+
+// NewIterator returns an Iterator over the keys in [start, end) positioned at the first key.
+// A nil start or end leaves the range unbounded on that side.
+func (t *LSMTree) NewIterator(start, end []byte) (*Iterator, error) {
+	return t.newIterator(start, end, false, nil)
+}
+
+// NewReverseIterator returns an Iterator over the keys in [start, end) in descending order,
+// positioned at the last key.
+// A nil start or end leaves the range unbounded on that side.
+func (t *LSMTree) NewReverseIterator(start, end []byte) (*Iterator, error) {
+	return t.newIterator(start, end, true, nil)
+}
+
+// newIterator takes the sources while holding mu, so the iterator sees a consistent set of tables,
+// and seeks once it is released. The disk tables are referenced, so they stay readable
+// when they are merged away later.
+// The iterator reads as of the snapshot, as of its creation for a nil snapshot.
+func (t *LSMTree) newIterator(start, end []byte, reverse bool, snapshot *Snapshot) (*Iterator, error) {
+	seq, iters, err := t.iteratorSources(start, end, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &Iterator{start: start, end: end, reverse: reverse, merged: newMergingIterator(iters, seq)}
+
+	if reverse {
+		err = it.seekToEnd()
+	} else {
+		err = it.Seek(start)
+	}
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// iteratorSources returns the read sequence number and the iterators over the memTables
+// and the disk tables holding keys in [start, end), newest first.
+func (t *LSMTree) iteratorSources(start, end []byte, snapshot *Snapshot) (uint64, []internalIterator, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return 0, nil, ErrClosed
+	}
+	seq, err := t.readSequence(snapshot)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	iters := []internalIterator{t.memTable.iterator()}
+	for i := len(t.immMemTables) - 1; i >= 0; i-- {
+		iters = append(iters, t.immMemTables[i].iterator())
+	}
+
+	// L0 is newest first and each higher level is older than the level above it.
+	for _, tables := range t.levels {
+		for _, table := range overlappingTables(tables, start, end) {
+			table.ref()
+			iters = append(iters, newTableIterator(table))
+		}
+	}
+	return seq, iters, nil
+}
+
+// Seek moves the iterator to the first key greater than or equal to key.
+// For a reverse Iterator, it moves to the last key less than or equal to key.
+// Keys outside of the range are moved to the nearest key in range.
+func (it *Iterator) Seek(key []byte) error {
+	if !it.reverse {
+		if it.start != nil && bytes.Compare(key, it.start) < 0 {
+			key = it.start
+		}
+		return it.found(it.merged.seek(seekKey(key, maxSequenceNumber)))
+	}
+
+	if it.end != nil && bytes.Compare(key, it.end) >= 0 {
+		return it.seekToEnd()
+	}
+	// The oldest possible record of key sorts after every record of key.
+	return it.found(it.merged.seekForPrev(makeInternalKey(key, 0, recordTypeDelete)))
+}
+
+// seekToEnd moves a reverse Iterator to the last key before end.
+func (it *Iterator) seekToEnd() error {
+	if it.end == nil {
+		return it.found(it.merged.seekToLast())
+	}
+	// No record has the largest sequence number, so the seek key of end
+	// sorts after every key before end and before every record of end.
+	return it.found(it.merged.seekForPrev(seekKey(it.end, maxSequenceNumber)))
+}
+
+// Next moves the iterator to the next key, the previous key for a reverse Iterator.
+func (it *Iterator) Next() error {
+	if !it.valid {
+		return nil
+	}
+	return it.found(it.merged.next())
+}
+
+// Valid returns true if the iterator is positioned at a key in range.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value at the current position.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Close closes all underlying iterators.
+func (it *Iterator) Close() error {
+	it.valid = false
+	return it.merged.close()
+}
+
+// found moves to the first live key in range from the position of the merged iterator.
+// Tombstones are skipped. err is the error of the last move of the merged iterator.
+func (it *Iterator) found(err error) error {
+	for {
+		if err != nil {
+			it.valid = false
+			return err
+		}
+		if !it.merged.valid() {
+			it.valid = false
+			return nil
+		}
+
+		key := extractUserKey(it.merged.key())
+		if !it.reverse && it.end != nil && bytes.Compare(key, it.end) >= 0 {
+			it.valid = false
+			return nil
+		}
+		if it.reverse && it.start != nil && bytes.Compare(key, it.start) < 0 {
+			it.valid = false
+			return nil
+		}
+
+		if it.merged.recordType() == recordTypeDelete {
+			err = it.merged.next()
+			continue
+		}
+
+		it.key, it.value = key, it.merged.value()
+		it.valid = true
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package lsmtree_test
+
+import (
+	"fmt"
+	"lsmtree"
+	"testing"
+)
+
+func collectKeys(t *testing.T, it *lsmtree.Iterator) []string {
+	var keys []string
+	for it.Valid() {
+		keys = append(keys, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+		if err := it.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func keysShouldBe(t *testing.T, got []string, want []string) {
+	if len(got) != len(want) {
+		t.Fatalf("Iterator failed: got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Iterator failed: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestIteratorRange(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 8, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spread versions of the keys over several disk tables and the memTable.
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		if err := tree.Put([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"b", "d", "f"} {
+		if err := tree.Put([]byte(key), []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"c", "h"} {
+		if err := tree.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := tree.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysShouldBe(t, collectKeys(t, it), []string{
+		"a=1", "b=2", "d=2", "e=1", "f=2", "g=1", "i=1", "j=1",
+	})
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err = tree.NewIterator([]byte("b"), []byte("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	keysShouldBe(t, collectKeys(t, it), []string{"b=2", "d=2", "e=1", "f=2"})
+
+	if err := it.Seek([]byte("dd")); err != nil {
+		t.Fatal(err)
+	}
+	keysShouldBe(t, collectKeys(t, it), []string{"e=1", "f=2"})
+
+	// Seek before start is clamped to start.
+	if err := it.Seek([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Valid() || string(it.Key()) != "b" {
+		t.Fatalf("Seek failed: should be positioned at b")
+	}
+}
+
+func TestIteratorEmpty(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 8, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := tree.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if it.Valid() {
+		t.Fatalf("Iterator failed: should be empty")
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 8, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		if err := tree.Put([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"b", "d", "f"} {
+		if err := tree.Put([]byte(key), []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"c", "h"} {
+		if err := tree.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := tree.NewReverseIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysShouldBe(t, collectKeys(t, it), []string{
+		"j=1", "i=1", "g=1", "f=2", "e=1", "d=2", "b=2", "a=1",
+	})
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err = tree.NewReverseIterator([]byte("b"), []byte("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	keysShouldBe(t, collectKeys(t, it), []string{"f=2", "e=1", "d=2", "b=2"})
+
+	if err := it.Seek([]byte("dd")); err != nil {
+		t.Fatal(err)
+	}
+	keysShouldBe(t, collectKeys(t, it), []string{"d=2", "b=2"})
+
+	// Seek after end is clamped to the last key before end.
+	if err := it.Seek([]byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Valid() || string(it.Key()) != "f" {
+		t.Fatalf("Seek failed: should be positioned at f")
+	}
+}
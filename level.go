@@ -0,0 +1,134 @@
+package lsmtree
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+)
+
+// numLevels is the number of levels of disk tables.
+// L0 receives flushed memTables and its disk tables may overlap, newest first.
+// Disk tables of L1 and higher do not overlap and are sorted by key.
+const numLevels = 7
+
+// tableMeta describes a live disk table.
+type tableMeta struct {
+	index int
+	// size is the number of bytes of its sstable file.
+	size int
+	// smallest and largest are the first and last keys in the disk table.
+	smallest, largest []byte
+	// smallestSeq and largestSeq are the smallest and largest sequence numbers of its records.
+	smallestSeq, largestSeq uint64
+	// filter is the bloom filter of the keys in the disk table.
+	// It is not recorded in the MANIFEST, it is read from the disk table on Open.
+	filter []byte
+	// reader is the open sstable of the disk table, shared by every read of the tree.
+	reader *sstReader
+	// refs counts the levels holding the disk table and the reads using its reader.
+	// The reader is closed once the disk table is removed from the levels and no read uses it.
+	// References are only taken while holding mu and the disk table is live.
+	refs int32
+}
+
+// ref takes a reference on the disk table, its reader stays open until unref.
+func (tm *tableMeta) ref() {
+	atomic.AddInt32(&tm.refs, 1)
+}
+
+// unref releases a reference on the disk table, the last one closes its reader.
+func (tm *tableMeta) unref() error {
+	if atomic.AddInt32(&tm.refs, -1) == 0 && tm.reader != nil {
+		return tm.reader.close()
+	}
+	return nil
+}
+
+// mayContain returns false if the disk table surely does not hold key.
+func (tm *tableMeta) mayContain(key []byte) bool {
+	return bloomFilterMayContain(tm.filter, key)
+}
+
+// overlaps reports whether the disk table holds keys in [start, end].
+// A nil start or end leaves the range unbounded on that side.
+func (tm *tableMeta) overlaps(start, end []byte) bool {
+	if end != nil && bytes.Compare(tm.smallest, end) > 0 {
+		return false
+	}
+	if start != nil && bytes.Compare(tm.largest, start) < 0 {
+		return false
+	}
+	return true
+}
+
+// overlappingTables returns the disk tables holding keys in [start, end].
+func overlappingTables(tables []*tableMeta, start, end []byte) []*tableMeta {
+	var overlapping []*tableMeta
+	for _, table := range tables {
+		if table.overlaps(start, end) {
+			overlapping = append(overlapping, table)
+		}
+	}
+	return overlapping
+}
+
+// findTable returns the disk table of a level above L0 that may hold key, nil if there is none.
+func findTable(tables []*tableMeta, key []byte) *tableMeta {
+	i := sort.Search(len(tables), func(i int) bool {
+		return bytes.Compare(tables[i].largest, key) >= 0
+	})
+	if i == len(tables) || bytes.Compare(tables[i].smallest, key) > 0 {
+		return nil
+	}
+	return tables[i]
+}
+
+// keyRange returns the smallest and largest key of the disk tables.
+func keyRange(tables []*tableMeta) ([]byte, []byte) {
+	var smallest, largest []byte
+	for i, table := range tables {
+		if i == 0 || bytes.Compare(table.smallest, smallest) < 0 {
+			smallest = table.smallest
+		}
+		if i == 0 || bytes.Compare(table.largest, largest) > 0 {
+			largest = table.largest
+		}
+	}
+	return smallest, largest
+}
+
+// totalSize returns the size of the disk tables in bytes.
+func totalSize(tables []*tableMeta) int {
+	size := 0
+	for _, table := range tables {
+		size += table.size
+	}
+	return size
+}
+
+// maxBytesForLevel returns the size target of a level above L0.
+func maxBytesForLevel(opts *Options, level int) float64 {
+	maxBytes := float64(opts.BaseLevelSize)
+	for ; level > 1; level-- {
+		maxBytes *= float64(opts.LevelSizeMultiplier)
+	}
+	return maxBytes
+}
+
+// removeTables returns the disk tables without the removed ones, in a new slice.
+func removeTables(tables []*tableMeta, removed []*tableMeta) []*tableMeta {
+	var kept []*tableMeta
+	for _, table := range tables {
+		isRemoved := false
+		for _, r := range removed {
+			if table == r {
+				isRemoved = true
+				break
+			}
+		}
+		if !isRemoved {
+			kept = append(kept, table)
+		}
+	}
+	return kept
+}
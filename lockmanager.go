@@ -0,0 +1,131 @@
+package lsmtree
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLockTimeout is returned when a pessimistic transaction waits longer than
+// Options.LockTimeout for a key lock.
+var ErrLockTimeout = errors.New("lsmtree: lock wait timeout")
+
+// ErrDeadlock is returned when waiting for a key lock would close a cycle of
+// transactions waiting for each other. The transaction should be rolled back.
+var ErrDeadlock = errors.New("lsmtree: deadlock")
+
+// lockManager holds the exclusive key locks of the pessimistic transactions.
+// Transactions are identified by their id.
+type lockManager struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// locks are the held key locks.
+	locks map[string]*keyLock
+	// waitsFor is the wait-for graph: every waiting transaction and the owner
+	// of the lock it waits for. A transaction waits for at most one lock at a time.
+	waitsFor map[uint64]uint64
+	// nextID is the id of the next transaction.
+	nextID uint64
+}
+
+// keyLock is a held key lock.
+type keyLock struct {
+	owner uint64
+	// released is closed when the lock is released.
+	released chan struct{}
+}
+
+// newLockManager returns a lockManager holding no locks.
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks:    make(map[string]*keyLock),
+		waitsFor: make(map[uint64]uint64),
+		nextID:   1,
+	}
+}
+
+// newID returns the id of a new transaction.
+func (lm *lockManager) newID() uint64 {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	id := lm.nextID
+	lm.nextID++
+	return id
+}
+
+// lock acquires the lock of key for the transaction, waiting at most timeout
+// for its owner to release it. Acquiring a lock already held by the transaction succeeds.
+// Returns ErrDeadlock without waiting if the owner waits, directly or not, for the transaction.
+func (lm *lockManager) lock(id uint64, key string, timeout time.Duration) error {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for {
+		l, held := lm.locks[key]
+		if !held {
+			lm.locks[key] = &keyLock{owner: id, released: make(chan struct{})}
+			delete(lm.waitsFor, id)
+			return nil
+		}
+		if l.owner == id {
+			delete(lm.waitsFor, id)
+			return nil
+		}
+
+		// The owner changes when waiters race for a released lock, the edge is updated every time.
+		lm.waitsFor[id] = l.owner
+		if lm.waitsForItself(id) {
+			delete(lm.waitsFor, id)
+			return ErrDeadlock
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+		}
+		lm.mu.Unlock()
+		select {
+		case <-l.released:
+			lm.mu.Lock()
+		case <-timer.C:
+			lm.mu.Lock()
+			delete(lm.waitsFor, id)
+			return ErrLockTimeout
+		}
+	}
+}
+
+// waitsForItself reports whether following the wait-for graph from the transaction leads back to it.
+// mu must be held.
+func (lm *lockManager) waitsForItself(id uint64) bool {
+	// Every transaction waits for at most one other, the path has no branch.
+	// It is at most as long as the number of waiting transactions unless it loops.
+	next, ok := lm.waitsFor[id]
+	for steps := 0; ok && steps <= len(lm.waitsFor); steps++ {
+		if next == id {
+			return true
+		}
+		next, ok = lm.waitsFor[next]
+	}
+	return false
+}
+
+// unlock releases the locks of the keys held by the transaction.
+func (lm *lockManager) unlock(id uint64, keys []string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for _, key := range keys {
+		if l, held := lm.locks[key]; held && l.owner == id {
+			delete(lm.locks, key)
+			close(l.released)
+		}
+	}
+}
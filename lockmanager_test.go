@@ -0,0 +1,86 @@
+package lsmtree
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForWaiter waits until the transaction waits for a lock.
+func waitForWaiter(lm *lockManager, id uint64) {
+	for {
+		lm.mu.Lock()
+		_, waiting := lm.waitsFor[id]
+		lm.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLockManager(t *testing.T) {
+	lm := newLockManager()
+	id1, id2 := lm.newID(), lm.newID()
+
+	if err := lm.lock(id1, "a", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.lock(id1, "a", time.Second); err != nil {
+		t.Fatalf("locking a held lock again should succeed, got %v", err)
+	}
+	if err := lm.lock(id2, "a", 10*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("lock should fail with ErrLockTimeout, got %v", err)
+	}
+
+	// A waiter gets the lock once it is released.
+	locked := make(chan error)
+	go func() {
+		locked <- lm.lock(id2, "a", time.Minute)
+	}()
+	waitForWaiter(lm, id2)
+	lm.unlock(id1, []string{"a"})
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	lm.unlock(id2, []string{"a"})
+	if len(lm.locks) != 0 || len(lm.waitsFor) != 0 {
+		t.Fatalf("lock manager should be empty, got %d locks and %d waiters", len(lm.locks), len(lm.waitsFor))
+	}
+}
+
+func TestLockManagerDeadlock(t *testing.T) {
+	lm := newLockManager()
+	id1, id2, id3 := lm.newID(), lm.newID(), lm.newID()
+
+	for id, key := range map[uint64]string{id1: "a", id2: "b", id3: "c"} {
+		if err := lm.lock(id, key, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// id1 waits for id2, which waits for id3: id3 waiting for id1 would close the cycle.
+	locked := make(chan error, 2)
+	go func() {
+		locked <- lm.lock(id1, "b", time.Minute)
+	}()
+	waitForWaiter(lm, id1)
+	go func() {
+		locked <- lm.lock(id2, "c", time.Minute)
+	}()
+	waitForWaiter(lm, id2)
+
+	if err := lm.lock(id3, "a", time.Minute); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("lock should fail with ErrDeadlock, got %v", err)
+	}
+
+	// Rolling back the victim lets the others go on.
+	lm.unlock(id3, []string{"c"})
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	lm.unlock(id2, []string{"b", "c"})
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,131 +1,456 @@
 package lsmtree
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"io"
 	"path"
+	"sync"
 )
 
+// lockFileName is the name of the file locked while the database is open.
+const lockFileName = "LOCK"
+
+// testCrashPoints holds, by FS, a func(step string) called at every step of Open, flushes and
+// compactions where a crash must leave a database that opens without losing writes.
+// Only tests set them, to inject crashes in the databases of their FS.
+var testCrashPoints sync.Map
+
+// crashPoint calls the crash point func of the FS, if any, at the step.
+func crashPoint(fs FS, step string) {
+	if f, ok := testCrashPoints.Load(fs); ok {
+		f.(func(step string))(step)
+	}
+}
+
+// LSMTree is a log structured merge tree.
+// It is safe for concurrent use. Writes are serialized, reads only wait
+// while a flush or compaction installs its result.
 type LSMTree struct {
+	// mu protects the fields below.
+	// Readers hold it shared to search the memTables and reference the disk tables
+	// they read, then read the disk tables without it. Flushes and compactions
+	// only hold it exclusively to install their results.
+	mu sync.RWMutex
+	// bgCond is signaled whenever the state watched by the background
+	// goroutines or by waiting writers changes.
+	bgCond *sync.Cond
+
 	// memTable stays in memory.
 	// Contains Key-Value pairs to be flushed to disk.
 	memTable *memTable
+	// immMemTables are full memTables waiting to be flushed, oldest first.
+	// They stay readable until their disk table is installed.
+	immMemTables []*memTable
 
-	diskTableNum       int
-	diskTableLastIndex int
+	// levels are the live disk tables of every level, each referenced once.
+	// It is replaced as a whole, never modified in place.
+	levels [numLevels][]*tableMeta
+	// nextDiskTableIndex is the index of the next disk table to be written.
+	nextDiskTableIndex int
+	// logNumber is the oldest WAL segment whose memTable is not flushed yet.
+	logNumber int
+	// nextWALNumber is the number of the next WAL segment.
+	nextWALNumber int
+	// lastSequence is the sequence number of the last committed write.
+	// It only changes while holding both writeMu and mu.
+	lastSequence uint64
+	// snapshots are the open snapshots, oldest first.
+	snapshots []*Snapshot
+	// compactPointers are the largest key of the last compaction of every level.
+	// The next compaction of the level starts after it.
+	compactPointers [numLevels][]byte
+	// flushedBytes and compactedBytes are the bytes written to disk tables by flushes and compactions.
+	flushedBytes, compactedBytes int
 
-	dbDir             string
-	sparseKeyDistance int
+	// closing tells the background goroutines to exit.
+	closing bool
+	closed  bool
+	// bgErr is the error that stopped the background goroutines or the WAL, if any.
+	// Every later write fails with it.
+	bgErr error
+	// compacting is true while the compaction goroutine runs a compaction.
+	compacting bool
+	// manualCompaction is the pending CompactRange request, if any.
+	manualCompaction *manualCompaction
 
-	wal *os.File
+	// writeQueueMu protects writeQueue, the writes waiting to be committed, oldest first.
+	writeQueueMu sync.Mutex
+	writeQueue   []*pendingWrite
+	// writeMu serializes the commits of groups of writes: WAL appends and memTable inserts.
+	writeMu sync.Mutex
+	// walWrites is the number of WAL writes, one per group commit, protected by writeMu.
+	walWrites int
+	// diskTableMu serializes changes to the disk tables: flushes and compactions.
+	// Both run in background goroutines.
+	diskTableMu sync.Mutex
+	// bgWG waits for the background goroutines.
+	bgWG sync.WaitGroup
+	// syncStop stops the background sync of the WAL with SyncPeriodic, syncWG waits for it.
+	syncStop     chan struct{}
+	syncStopOnce sync.Once
+	syncWG       sync.WaitGroup
+
+	// wal is the WAL segment of the memTable, only replaced while holding both writeMu and mu.
+	wal File
+	// manifest is the live MANIFEST, appended to while holding mu.
+	manifest *manifest
+
+	// locks are the key locks of the pessimistic transactions.
+	locks *lockManager
+
+	// fileLock is the lock of the database directory, held until Close.
+	fileLock io.Closer
+
+	dbDir string
+	fs    FS
+	opts  *Options
 }
 
-const (
-	// memTableThreshold is the number of key-value pairs in the memTable before it is flushed to disk.
-	memTableThreshold = 4
+// ErrClosed is returned by every call on a closed LSMTree.
+var ErrClosed = errors.New("lsmtree: closed")
 
-	// mergeThreshold is the number of disk tables to merge.
-	mergeThreshold = 2
+// Open opens the database in dbDir with the given options, dbDir is created if needed.
+// A nil opts uses the default options.
+// A corrupted MANIFEST is reported as an error, corrupted WAL records are handled as told by opts.WALRecovery.
+// It fails with ErrLocked if the database is already open.
+func Open(dbDir string, opts *Options) (*LSMTree, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 
-	// walFileName is the name of WAL file
-	walFileName = "wal.dat"
-)
+	fs := opts.FS
+	if err := fs.MkdirAll(dbDir); err != nil {
+		return nil, err
+	}
+	fileLock, err := fs.Lock(path.Join(dbDir, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("lsmtree: locking %s: %w", dbDir, err)
+	}
+	t, err := open(dbDir, opts, fileLock)
+	if err != nil {
+		fileLock.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens the database in dbDir once its lock is taken.
+func open(dbDir string, opts *Options, fileLock io.Closer) (*LSMTree, error) {
+	fs := opts.FS
+
+	if err := checkOptionsFile(fs, dbDir, opts); err != nil {
+		return nil, err
+	}
+
+	v, manifestNumber, err := recoverManifest(fs, dbDir, opts.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("lsmtree: recovering MANIFEST: %w", err)
+	}
 
-func NewLSMTree(dbDir string, sparseKeyDistance int) *LSMTree {
-	diskTableNum, diskTableLastIndex, err := readMetaData(dbDir)
+	// Segments before the log number are flushed, they are left over if a crash
+	// happened before they were deleted.
+	walNumbers, err := listWALs(fs, dbDir)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	for len(walNumbers) > 0 && walNumbers[0] < v.logNumber {
+		if err := deleteWAL(fs, dbDir, walNumbers[0]); err != nil {
+			return nil, err
+		}
+		walNumbers = walNumbers[1:]
 	}
 
-	walPath := path.Join(dbDir, walFileName)
-	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	// Every segment but the last one holds a full memTable waiting to be flushed,
+	// writes are appended to the last one.
+	mts, wal, err := recoverWALs(fs, dbDir, walNumbers, opts.WALRecovery, opts.Logger)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if wal == nil {
+		mt := newMemTable()
+		mt.walNumber = v.logNumber
+		if wal, err = createWAL(fs, dbDir, mt.walNumber); err != nil {
+			return nil, err
+		}
+		mts = append(mts, mt)
+	}
+	mt := mts[len(mts)-1]
+
+	// Records replayed from the WAL may be newer than the MANIFEST.
+	lastSequence := v.lastSequence
+	for _, mt := range mts {
+		if mt.lastSequence > lastSequence {
+			lastSequence = mt.lastSequence
+		}
 	}
 
-	mt, err := loadWAL(wal)
+	// The replayed MANIFEST is replaced by a new one holding only the current state.
+	manifest, err := createManifest(fs, dbDir, manifestNumber+1, v)
 	if err != nil {
-		panic(err)
+		wal.Close()
+		return nil, err
+	}
+	crashPoint(fs, "open: MANIFEST written")
+	if err := setCurrent(fs, dbDir, manifest.number); err != nil {
+		wal.Close()
+		manifest.close()
+		return nil, err
+	}
+	crashPoint(fs, "open: CURRENT switched")
+	if err := removeObsoleteFiles(fs, dbDir, v, manifest.number, opts.Logger); err != nil {
+		wal.Close()
+		manifest.close()
+		return nil, err
+	}
+
+	var tables []*tableMeta
+	for _, levelTables := range v.levels {
+		tables = append(tables, levelTables...)
+	}
+	for _, table := range tables {
+		if err := openDiskTable(fs, dbDir, table, !opts.DisableChecksumVerification); err != nil {
+			closeDiskTables(tables)
+			wal.Close()
+			manifest.close()
+			return nil, fmt.Errorf("lsmtree: opening disk table %d: %w", table.index, err)
+		}
+		table.ref()
 	}
 
-	return &LSMTree{
+	t := &LSMTree{
 		memTable:           mt,
-		diskTableNum:       diskTableNum,
-		diskTableLastIndex: diskTableLastIndex,
+		immMemTables:       mts[:len(mts)-1],
+		levels:             v.levels,
+		nextDiskTableIndex: v.nextDiskTableIndex,
+		logNumber:          v.logNumber,
+		lastSequence:       lastSequence,
+		nextWALNumber:      mt.walNumber + 1,
+		fileLock:           fileLock,
 		dbDir:              dbDir,
-		sparseKeyDistance:  sparseKeyDistance,
+		fs:                 fs,
+		opts:               opts,
 		wal:                wal,
+		manifest:           manifest,
+		locks:              newLockManager(),
+	}
+	t.bgCond = sync.NewCond(&t.mu)
+
+	t.bgWG.Add(2)
+	go t.flushLoop()
+	go t.compactionLoop()
+	if opts.Sync == SyncPeriodic {
+		t.syncStop = make(chan struct{})
+		t.syncWG.Add(1)
+		go t.syncLoop()
 	}
+
+	return t, nil
 }
 
-func (t *LSMTree) Put(key, value []byte) error {
+// Close waits for the background flush of the immutable memTables and for a
+// running compaction, then closes the MANIFEST, syncs
+// the WAL, closes it and releases the lock of the database. The memTable is recovered from the WAL on the next Open.
+// Every later call returns ErrClosed.
+func (t *LSMTree) Close() error {
+	// The background sync takes writeMu, it is stopped first.
+	t.stopSync()
 
-	if err := appendWAL(t.wal, key, value); err != nil {
-		return err
-	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
 
-	if err := t.memTable.put(key, value); err != nil {
-		return err
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		return ErrClosed
 	}
+	t.closing = true
+	t.bgCond.Broadcast()
+	t.mu.Unlock()
 
-	if t.memTable.keys >= memTableThreshold {
-		// Flush memTable to disk.
-		if err := t.Flush(); err != nil {
-			return err
+	t.bgWG.Wait()
+
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	// The lock is released last, once no file is written anymore.
+	defer t.fileLock.Close()
+
+	// Iterators still open keep the readers of their disk tables.
+	for _, tables := range t.levels {
+		for _, table := range tables {
+			table.unref()
 		}
 	}
 
-	if t.diskTableNum > mergeThreshold {
-		// merge oldest and oldest+1 disk tables.
-		oldest := t.diskTableLastIndex - t.diskTableNum + 1
-		if err := mergeDiskTables(t.dbDir, oldest, oldest+1, t.sparseKeyDistance); err != nil {
+	if err := t.manifest.close(); err != nil {
+		t.wal.Close()
+		return err
+	}
+	if err := t.wal.Sync(); err != nil {
+		t.wal.Close()
+		return err
+	}
+	return t.wal.Close()
+}
+
+// Put sets the value for the given key. An empty value is stored as is and
+// is not treated as a deletion.
+func (t *LSMTree) Put(key, value []byte) error {
+	var batch WriteBatch
+	batch.Put(key, value)
+	return t.Write(&batch)
+}
+
+// Delete removes the given key by writing a tombstone.
+func (t *LSMTree) Delete(key []byte) error {
+	var batch WriteBatch
+	batch.Delete(key)
+	return t.Write(&batch)
+}
+
+// makeRoomForWrite freezes the memTable once it is full.
+// Writers stall while MaxImmutableMemTables memTables are waiting to be flushed.
+// writeMu must be held.
+func (t *LSMTree) makeRoomForWrite() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		if t.closing {
+			return ErrClosed
+		}
+		if t.bgErr != nil {
+			return t.bgErr
+		}
+		if t.memTable.size < t.opts.MemTableSize {
+			return nil
+		}
+		if len(t.immMemTables) >= t.opts.MaxImmutableMemTables {
+			t.opts.Logger.Printf("lsmtree: %d immutable memTables waiting for flush, stalling writes", len(t.immMemTables))
+			t.bgCond.Wait()
+			continue
+		}
+		if err := t.freezeMemTable(); err != nil {
 			return err
 		}
+	}
+}
 
-		newDiskTableNum := t.diskTableNum - 1
-		if err := writeMetaData(t.dbDir, newDiskTableNum, t.diskTableLastIndex); err != nil {
+// freezeMemTable moves the memTable to the immutable memTables and wakes the flush goroutine.
+// The new memTable starts a new WAL segment, the segment of the frozen memTable is closed.
+// writeMu and mu must be held.
+func (t *LSMTree) freezeMemTable() error {
+	wal, err := createWAL(t.fs, t.dbDir, t.nextWALNumber)
+	if err != nil {
+		return err
+	}
+	// The periodic sync would miss the tail of the frozen segment.
+	if t.opts.Sync == SyncPeriodic {
+		if err := t.wal.Sync(); err != nil {
+			wal.Close()
 			return err
 		}
-
-		t.diskTableNum--
+	}
+	if err := t.wal.Close(); err != nil {
+		wal.Close()
+		return err
 	}
 
+	t.wal = wal
+	t.immMemTables = append(t.immMemTables, t.memTable)
+	t.memTable = newMemTable()
+	t.memTable.walNumber = t.nextWALNumber
+	t.nextWALNumber++
+	t.bgCond.Broadcast()
 	return nil
 }
 
+// Get returns the value for the given key.
+// Deleted keys are reported as not found.
 func (t *LSMTree) Get(key []byte) ([]byte, bool, error) {
-	value, exists := t.memTable.get(key)
+	return t.get(key, nil)
+}
+
+// get returns the value for the given key as of the snapshot, the latest value for a nil snapshot.
+func (t *LSMTree) get(key []byte, snapshot *Snapshot) ([]byte, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return nil, false, ErrClosed
+	}
+	seq, err := t.readSequence(snapshot)
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, ikey, exists, err := t.lookup(key, seq)
+	if err != nil || !exists || internalKeyType(ikey) == recordTypeDelete {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// lookup returns the value and the internal key of the newest record of key visible at the sequence number.
+// Tombstones are reported as found. mu must be held for reading, it is released while the disk tables are read.
+func (t *LSMTree) lookup(key []byte, seq uint64) ([]byte, []byte, bool, error) {
+	value, ikey, exists := t.memTable.get(key, seq)
+	for i := len(t.immMemTables) - 1; !exists && i >= 0; i-- {
+		value, ikey, exists = t.immMemTables[i].get(key, seq)
+	}
 	if exists {
-		return value, exists, nil
+		return value, ikey, true, nil
 	}
 
-	diskTableFirstIndex := t.diskTableLastIndex - t.diskTableNum + 1
-	for i := t.diskTableLastIndex; i >= diskTableFirstIndex; i-- {
-		value, exists, err := searchDiskTable(t.dbDir, i, key)
-		if err != nil {
-			return nil, false, err
+	// L0 disk tables may overlap and are searched newest first.
+	// Higher levels hold at most one disk table with the key.
+	// Disk tables whose bloom filter rules out the key are not read.
+	var candidates []*tableMeta
+	for _, table := range t.levels[0] {
+		if table.overlaps(key, key) && table.mayContain(key) {
+			candidates = append(candidates, table)
 		}
-		if exists {
-			return value, exists, nil
+	}
+	for level := 1; level < numLevels; level++ {
+		if table := findTable(t.levels[level], key); table != nil && table.mayContain(key) {
+			candidates = append(candidates, table)
 		}
 	}
 
-	return nil, false, nil
+	if len(candidates) == 0 {
+		return nil, nil, false, nil
+	}
+
+	// The references keep the disk tables readable if a compaction removes them meanwhile.
+	for _, table := range candidates {
+		table.ref()
+	}
+	t.mu.RUnlock()
+	defer t.mu.RLock()
+	return searchDiskTables(candidates, key, seq)
 }
 
+// Flush freezes the memTable and waits until every immutable memTable is written to disk.
 func (t *LSMTree) Flush() error {
-	newDiskTableNum := t.diskTableNum + 1
-	newDiskTableLastIndex := t.diskTableLastIndex + 1
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
 
-	if err := createDiskTable(t.memTable, t.dbDir, newDiskTableLastIndex, t.sparseKeyDistance); err != nil {
-		return err
-	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	if err := writeMetaData(t.dbDir, newDiskTableNum, newDiskTableLastIndex); err != nil {
-		return err
+	if t.closing {
+		return ErrClosed
 	}
-
-	t.memTable.clear()
-	t.diskTableNum = newDiskTableNum
-	t.diskTableLastIndex = newDiskTableLastIndex
-	return nil
+	if t.memTable.keys > 0 {
+		if err := t.freezeMemTable(); err != nil {
+			return err
+		}
+	}
+	for len(t.immMemTables) > 0 && t.bgErr == nil {
+		t.bgCond.Wait()
+	}
+	return t.bgErr
 }
@@ -1,13 +1,23 @@
 package lsmtree_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"lsmtree"
 	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
 func TestLSMTreePut(t *testing.T) {
-	tree := lsmtree.NewLSMTree(os.TempDir(), 1)
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	key := []byte("key")
 	value := []byte("value")
@@ -43,8 +53,11 @@ func TestLSMTreeDiskTable(t *testing.T) {
 	// rand.Seed(time.Now().UnixNano())
 	// rand.Shuffle(len(elems), func(i, j int) { elems[i], elems[j] = elems[j], elems[i] })
 
-	dir := os.TempDir()
-	tree := lsmtree.NewLSMTree(dir, 2)
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("Tmp dir: %s", dir)
 	for _, elem := range elems {
 		tree.Put(elem.Key, elem.Value)
@@ -54,7 +67,7 @@ func TestLSMTreeDiskTable(t *testing.T) {
 	t.Logf("Value for key 7: %s", value)
 }
 
-func TestLSMTreeDiskTableSparse(t *testing.T) {
+func TestLSMTreeDiskTableBlocks(t *testing.T) {
 	type Element struct {
 		Key   []byte
 		Value []byte
@@ -74,42 +87,416 @@ func TestLSMTreeDiskTableSparse(t *testing.T) {
 		{Key: []byte("12"), Value: []byte("Twelve")},
 	}
 
-	dir := os.TempDir()
-	tree := lsmtree.NewLSMTree(dir, 2)
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("Tmp dir: %s", dir)
 	for _, elem := range elems {
 		tree.Put(elem.Key, elem.Value)
 	}
 
-	value, _, err := tree.Get([]byte("2"))
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every disk table spans several data blocks.
+	for _, elem := range elems {
+		value, exists, err := tree.Get(elem.Key)
+		if err != nil {
+			t.Fatalf("Get failed: %s", err)
+		}
+		if !exists || !bytes.Equal(value, elem.Value) {
+			t.Fatalf("Get failed: key %s should be %s, got %s", elem.Key, elem.Value, value)
+		}
+	}
+	if _, exists, err := tree.Get([]byte("0")); err != nil || exists {
+		t.Fatalf("Get failed: key 0 should not exist, got %v %v", exists, err)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
 	if err != nil {
-		t.Errorf("Get failed: %s", err)
+		t.Fatal(err)
+	}
+	tree.Put([]byte("1"), []byte("One"))
+	tree.Put([]byte("3"), []byte("Three"))
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := tree.Get([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "Three" {
+		t.Fatalf("Value for key 3 should be Three, got %s", value)
+	}
+	t.Logf("Value for key 3: %s", value)
+}
+
+func TestLSMTreeDelete(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 28, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	for _, key := range keys {
+		if err := tree.Put([]byte(key), []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "2" only lives on disk, "9" still lives in the memTable.
+	for _, key := range []string{"2", "9"} {
+		if err := tree.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		_, exists, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("Get failed: key %s should be deleted", key)
+		}
 	}
-	t.Logf("Value for key 2: %s", value)
-	// searchSparseIndex: key 2, from 0, to 0, exists false
-	// searchSparseIndex: key 2, from 0, to 50, exists true
 
-	tree.Get([]byte("3"))
-	// searchSparseIndex: key 3, from 0, to 0, exists false
-	// searchSparseIndex: key 3, from 50, to 50, exists true
+	// Flush and merge the tombstones into disk tables.
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := tree.Put([]byte(key), []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"2", "9"} {
+		_, exists, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("Get failed: key %s should stay deleted after flush", key)
+		}
+	}
+
+	value, exists, err := tree.Get([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || string(value) != "value3" {
+		t.Errorf("Get failed: key 3 should be value3, got %s", value)
+	}
+}
 
-	tree.Get([]byte("1"))
-	//searchSparseIndex: key 1, from 0, to 0, exists false
-	//searchSparseIndex: key 1, from 0, to 0, exists true
+func TestLSMTreeEmptyValue(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 16, L0CompactionTrigger: 3, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	tree.Get([]byte("4"))
-	// searchSparseIndex: key 4, from 0, to 0, exists true
-	// searchSparseIndex: key 4, from 50, to 0, exists true
+	if err := tree.Put([]byte("empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"1", "2", "3", "4"} {
+		if err := tree.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	tree.Get([]byte("12"))
+	value, exists, err := tree.Get([]byte("empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("Get failed: empty value should exist")
+	}
+	if len(value) != 0 {
+		t.Errorf("Get failed: value should be empty, got %s", value)
+	}
 }
 
-func TestWAL(t *testing.T) {
-	dir := os.TempDir()
-	tree := lsmtree.NewLSMTree(dir, 2)
-	value, _, err := tree.Get([]byte("3"))
+func TestLSMTreeClose(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{FS: fs})
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("Value for key 3: %s", value)
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != lsmtree.ErrClosed {
+		t.Errorf("Put after Close should return ErrClosed, got %v", err)
+	}
+	if err := tree.Delete([]byte("key")); err != lsmtree.ErrClosed {
+		t.Errorf("Delete after Close should return ErrClosed, got %v", err)
+	}
+	if _, _, err := tree.Get([]byte("key")); err != lsmtree.ErrClosed {
+		t.Errorf("Get after Close should return ErrClosed, got %v", err)
+	}
+	if _, err := tree.NewIterator(nil, nil); err != lsmtree.ErrClosed {
+		t.Errorf("NewIterator after Close should return ErrClosed, got %v", err)
+	}
+	if err := tree.Flush(); err != lsmtree.ErrClosed {
+		t.Errorf("Flush after Close should return ErrClosed, got %v", err)
+	}
+	if err := tree.Close(); err != lsmtree.ErrClosed {
+		t.Errorf("Close after Close should return ErrClosed, got %v", err)
+	}
+
+	tree, err = lsmtree.Open(dir, &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	value, exists, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || string(value) != "value" {
+		t.Errorf("Get after reopen failed: got %s", value)
+	}
+}
+
+func TestOpenCreatesDir(t *testing.T) {
+	dbDir := path.Join(t.TempDir(), "nested", "db")
+
+	tree, err := lsmtree.Open(dbDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if _, err := os.Stat(dbDir); err != nil {
+		t.Fatalf("Open should create %s: %s", dbDir, err)
+	}
+}
+
+func TestOpenCorruptWAL(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the checksum of the first record with garbage.
+	wal, err := fs.OpenReadWrite(path.Join(dir, "0.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Write([]byte{0xff, 0xff, 0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	_, err = lsmtree.Open(dir, &lsmtree.Options{WALRecovery: lsmtree.WALRecoveryAbsoluteConsistency, FS: fs})
+	var corruption *lsmtree.CorruptionError
+	if !errors.As(err, &corruption) || !errors.Is(err, lsmtree.ErrCorruption) {
+		t.Fatalf("Open should report the corrupt WAL with ErrCorruption, got %v", err)
+	}
+	if corruption.Path != path.Join(dir, "0.wal") || corruption.Offset != 0 {
+		t.Fatalf("corruption should be reported in 0.wal at offset 0, got %s at offset %d", corruption.Path, corruption.Offset)
+	}
+
+	// The default recovery mode drops the corrupted record.
+	tree, err = lsmtree.Open(dir, &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if _, exists, err := tree.Get([]byte("key")); err != nil || exists {
+		t.Fatalf("key should have been dropped, got %v %v", exists, err)
+	}
+}
+
+func TestLSMTreeConcurrent(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{MemTableSize: 256, L0CompactionTrigger: 3, BlockSize: 32, Sync: lsmtree.SyncNever, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const writers, keysPerWriter = 4, 100
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				key := []byte(fmt.Sprintf("%d-%03d", w, i))
+				if err := tree.Put(key, key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := []byte(fmt.Sprintf("%d-%03d", r, r*7))
+				value, exists, err := tree.Get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if exists && !bytes.Equal(key, value) {
+					t.Errorf("Get failed: key %s has value %s", key, value)
+				}
+
+				it, err := tree.NewIterator(nil, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var prev []byte
+				for it.Valid() {
+					if prev != nil && bytes.Compare(prev, it.Key()) >= 0 {
+						t.Errorf("Iterator failed: prev key %s next key %s", prev, it.Key())
+					}
+					prev = it.Key()
+					if err := it.Next(); err != nil {
+						t.Error(err)
+						break
+					}
+				}
+				it.Close()
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			key := []byte(fmt.Sprintf("%d-%03d", w, i))
+			value, exists, err := tree.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exists || !bytes.Equal(key, value) {
+				t.Fatalf("Get failed: key %s has value %s", key, value)
+			}
+		}
+	}
+}
+
+// BenchmarkPutConcurrent measures the throughput of many concurrent writers in every sync mode.
+func BenchmarkPutConcurrent(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		sync lsmtree.SyncMode
+	}{
+		{"SyncAlways", lsmtree.SyncAlways},
+		{"SyncPeriodic", lsmtree.SyncPeriodic},
+		{"SyncNever", lsmtree.SyncNever},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			tree, err := lsmtree.Open("db", &lsmtree.Options{Sync: mode.sync, FS: lsmtree.NewMemFS()})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tree.Close()
+
+			var n int64
+			value := make([]byte, 100)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := []byte(fmt.Sprintf("key%016d", atomic.AddInt64(&n, 1)))
+					if err := tree.Put(key, value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestLSMTreeWriteBatch(t *testing.T) {
+	fs, dir := lsmtree.NewMemFS(), "db"
+	tree, err := lsmtree.Open(dir, &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("index:1"), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch lsmtree.WriteBatch
+	batch.Put([]byte("record:1"), []byte("value"))
+	batch.Put([]byte("index:value"), []byte("record:1"))
+	batch.Delete([]byte("index:1"))
+	if err := tree.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch may be replicated through its serialized form.
+	var replica lsmtree.WriteBatch
+	if err := replica.SetData(batch.Data()); err != nil {
+		t.Fatal(err)
+	}
+	replicaTree, err := lsmtree.Open("replica", &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaTree.Close()
+	if err := replicaTree.Write(&replica); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = lsmtree.Open(dir, &lsmtree.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for _, db := range []*lsmtree.LSMTree{tree, replicaTree} {
+		if value, _, err := db.Get([]byte("record:1")); err != nil || string(value) != "value" {
+			t.Fatalf("record:1 should be value, got %s %v", value, err)
+		}
+		if value, _, err := db.Get([]byte("index:value")); err != nil || string(value) != "record:1" {
+			t.Fatalf("index:value should be record:1, got %s %v", value, err)
+		}
+		if _, exists, err := db.Get([]byte("index:1")); err != nil || exists {
+			t.Fatalf("index:1 should be deleted, got %v %v", exists, err)
+		}
+	}
 }
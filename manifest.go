@@ -0,0 +1,435 @@
+package lsmtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The MANIFEST is an append-only log of version edits, every change to the disk tables
+// is committed by appending one edit. Edits are framed like WAL records.
+// CURRENT holds the name of the live MANIFEST. On Open the MANIFEST is replayed,
+// then a new one starting with the whole state is written and CURRENT is switched to it.
+
+// version edit format:
+// [log number][next disk table index][last sequence number][number of deleted tables][number of added tables]
+// then for every deleted table: [level][index]
+// then for every added table:
+// [level][index][size][smallest sequence number][largest sequence number]
+// [smallest key length][smallest key][largest key length][largest key]
+
+const (
+	// currentFileName is the name of the file holding the name of the live MANIFEST.
+	currentFileName = "CURRENT"
+	// currentTempFileName is the name CURRENT is written to before being renamed to currentFileName.
+	currentTempFileName = "CURRENT.tmp"
+	// manifestFileNamePrefix is the prefix of the MANIFEST files, followed by their number.
+	manifestFileNamePrefix = "MANIFEST-"
+)
+
+// versionEdit is a change to the disk tables, a record of the MANIFEST.
+type versionEdit struct {
+	// logNumber is the oldest WAL segment not flushed yet.
+	logNumber int
+	// nextDiskTableIndex is the index of the next disk table.
+	nextDiskTableIndex int
+	// lastSequence is the last sequence number used, at least the sequence number of every record in the disk tables.
+	lastSequence uint64
+
+	deleted []deletedTable
+	added   []addedTable
+}
+
+// deletedTable is a disk table removed from a level by a versionEdit.
+type deletedTable struct {
+	level, index int
+}
+
+// addedTable is a disk table added to a level by a versionEdit.
+type addedTable struct {
+	level int
+	table *tableMeta
+}
+
+// deleteTable records the removal of the disk table from the level.
+func (ve *versionEdit) deleteTable(level int, table *tableMeta) {
+	ve.deleted = append(ve.deleted, deletedTable{level: level, index: table.index})
+}
+
+// addTable records the addition of the disk table to the level.
+func (ve *versionEdit) addTable(level int, table *tableMeta) {
+	ve.added = append(ve.added, addedTable{level: level, table: table})
+}
+
+// encode returns the encoded version edit.
+func (ve *versionEdit) encode() []byte {
+	var buf bytes.Buffer
+	buf.Write(encodeInt(ve.logNumber))
+	buf.Write(encodeInt(ve.nextDiskTableIndex))
+	buf.Write(encodeUint64(ve.lastSequence))
+	buf.Write(encodeInt(len(ve.deleted)))
+	buf.Write(encodeInt(len(ve.added)))
+
+	for _, d := range ve.deleted {
+		buf.Write(encodeInt(d.level))
+		buf.Write(encodeInt(d.index))
+	}
+	for _, a := range ve.added {
+		buf.Write(encodeInt(a.level))
+		buf.Write(encodeInt(a.table.index))
+		buf.Write(encodeInt(a.table.size))
+		buf.Write(encodeUint64(a.table.smallestSeq))
+		buf.Write(encodeUint64(a.table.largestSeq))
+		// Writes to a bytes.Buffer do not fail.
+		encode(&buf, a.table.smallest, a.table.largest, recordTypePut)
+	}
+	return buf.Bytes()
+}
+
+// decodeVersionEdit decodes a version edit encoded by encode.
+// Returns errCorruptRecord if the data cannot be a valid version edit.
+func decodeVersionEdit(data []byte) (*versionEdit, error) {
+	r := bytes.NewReader(data)
+	var fields [5]uint64
+	for i := range fields {
+		if err := binary.Read(r, binary.BigEndian, &fields[i]); err != nil {
+			return nil, errCorruptRecord
+		}
+	}
+	ve := &versionEdit{
+		logNumber:          int(fields[0]),
+		nextDiskTableIndex: int(fields[1]),
+		lastSequence:       fields[2],
+	}
+	// Every deleted table takes 16 bytes and every added table more, larger counts are corrupted.
+	numDeleted, numAdded := fields[3], fields[4]
+	if numDeleted > uint64(r.Len())/16 || numAdded > uint64(r.Len())/16 {
+		return nil, errCorruptRecord
+	}
+
+	for i := uint64(0); i < numDeleted; i++ {
+		var d [2]uint64
+		if err := binary.Read(r, binary.BigEndian, &d); err != nil {
+			return nil, errCorruptRecord
+		}
+		ve.deleted = append(ve.deleted, deletedTable{level: int(d[0]), index: int(d[1])})
+	}
+	for i := uint64(0); i < numAdded; i++ {
+		var a [5]uint64
+		if err := binary.Read(r, binary.BigEndian, &a); err != nil {
+			return nil, errCorruptRecord
+		}
+		smallest, largest, _, err := decode(r)
+		if err != nil {
+			return nil, errCorruptRecord
+		}
+		ve.added = append(ve.added, addedTable{level: int(a[0]), table: &tableMeta{
+			index:       int(a[1]),
+			size:        int(a[2]),
+			smallestSeq: a[3],
+			largestSeq:  a[4],
+			smallest:    smallest,
+			largest:     largest,
+		}})
+	}
+	if r.Len() != 0 {
+		return nil, errCorruptRecord
+	}
+	return ve, nil
+}
+
+// encodeUint64 encodes the uint64 to slice of bytes.
+func encodeUint64(i uint64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], i)
+	return encoded[:]
+}
+
+// version is the state of the disk tables recorded by the MANIFEST.
+type version struct {
+	// levels are the disk tables of every level.
+	levels [numLevels][]*tableMeta
+	// nextDiskTableIndex is the index of the next disk table.
+	nextDiskTableIndex int
+	// logNumber is the oldest WAL segment not flushed yet.
+	logNumber int
+	// lastSequence is the last sequence number recorded by an edit.
+	lastSequence uint64
+}
+
+// version returns the state of the disk tables of the tree. mu must be held.
+func (t *LSMTree) version() *version {
+	return &version{
+		levels:             t.levels,
+		nextDiskTableIndex: t.nextDiskTableIndex,
+		logNumber:          t.logNumber,
+		lastSequence:       t.lastSequence,
+	}
+}
+
+// apply applies the version edit. The levels it changes are replaced by new slices.
+// L0 is kept newest first by sequence numbers, higher levels are sorted by key.
+func (v *version) apply(ve *versionEdit) error {
+	levels := v.levels
+	var changed [numLevels]bool
+	for _, d := range ve.deleted {
+		if d.level < 0 || d.level >= numLevels {
+			return fmt.Errorf("version edit deletes disk table %d from unknown level %d", d.index, d.level)
+		}
+		tables := levels[d.level]
+		i := 0
+		for i < len(tables) && tables[i].index != d.index {
+			i++
+		}
+		if i == len(tables) {
+			return fmt.Errorf("version edit deletes disk table %d missing from L%d", d.index, d.level)
+		}
+		levels[d.level] = append(append([]*tableMeta{}, tables[:i]...), tables[i+1:]...)
+		changed[d.level] = true
+	}
+	for _, a := range ve.added {
+		if a.level < 0 || a.level >= numLevels {
+			return fmt.Errorf("version edit adds disk table %d to unknown level %d", a.table.index, a.level)
+		}
+		levels[a.level] = append(append([]*tableMeta{}, levels[a.level]...), a.table)
+		changed[a.level] = true
+	}
+
+	for level, tables := range levels {
+		if !changed[level] {
+			continue
+		}
+		if level == 0 {
+			// Every flushed memTable holds newer writes than the previous one and L0 compactions
+			// merge adjacent disk tables, so the sequence ranges of L0 disk tables do not overlap.
+			sort.Slice(tables, func(i, j int) bool {
+				if tables[i].largestSeq != tables[j].largestSeq {
+					return tables[i].largestSeq > tables[j].largestSeq
+				}
+				return tables[i].index > tables[j].index
+			})
+			continue
+		}
+		sort.Slice(tables, func(i, j int) bool {
+			return bytes.Compare(tables[i].smallest, tables[j].smallest) < 0
+		})
+	}
+
+	v.levels = levels
+	v.logNumber = ve.logNumber
+	v.nextDiskTableIndex = ve.nextDiskTableIndex
+	v.lastSequence = ve.lastSequence
+	return nil
+}
+
+// snapshot returns a version edit creating the version from nothing.
+func (v *version) snapshot() *versionEdit {
+	ve := &versionEdit{
+		logNumber:          v.logNumber,
+		nextDiskTableIndex: v.nextDiskTableIndex,
+		lastSequence:       v.lastSequence,
+	}
+	for level, tables := range v.levels {
+		for _, table := range tables {
+			ve.addTable(level, table)
+		}
+	}
+	return ve
+}
+
+// manifestFileName returns the name of the MANIFEST file for giving MANIFEST number.
+func manifestFileName(number int) string {
+	return manifestFileNamePrefix + strconv.Itoa(number)
+}
+
+// manifest is the live MANIFEST, open for appending.
+type manifest struct {
+	file   File
+	number int
+}
+
+// createManifest writes a new MANIFEST starting with the version.
+// It becomes the live one once CURRENT is switched to it by setCurrent.
+func createManifest(fs FS, dbDir string, number int, v *version) (*manifest, error) {
+	f, err := fs.Create(path.Join(dbDir, manifestFileName(number)))
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{file: f, number: number}
+	if err := m.append(v.snapshot()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// append appends the version edit to the MANIFEST and syncs it.
+func (m *manifest) append(ve *versionEdit) error {
+	var buf bytes.Buffer
+	encodeWALRecord(&buf, ve.encode())
+	if _, err := m.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+// close closes the MANIFEST.
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+// setCurrent points CURRENT to the MANIFEST.
+// It is written to a temporary file first, then renamed over the old CURRENT.
+func setCurrent(fs FS, dbDir string, number int) error {
+	currentTempFilePath := path.Join(dbDir, currentTempFileName)
+	f, err := fs.Create(currentTempFilePath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(manifestFileName(number) + "\n")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(currentTempFilePath, path.Join(dbDir, currentFileName)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dbDir)
+}
+
+// readCurrent returns the number of the MANIFEST named by CURRENT.
+// A database without CURRENT has no MANIFEST yet, exists is false.
+func readCurrent(fs FS, dbDir string) (int, bool, error) {
+	f, err := fs.Open(path.Join(dbDir, currentFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	defer f.Close()
+
+	name, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	name = strings.TrimSuffix(name, "\n")
+	number, err := strconv.Atoi(strings.TrimPrefix(name, manifestFileNamePrefix))
+	if err != nil || number < 0 || !strings.HasPrefix(name, manifestFileNamePrefix) {
+		return 0, false, fmt.Errorf("%w: %s names no MANIFEST: %q", ErrCorruption, currentFileName, name)
+	}
+	return number, true, nil
+}
+
+// recoverManifest replays the MANIFEST named by CURRENT.
+// Returns the recovered version and the number of the MANIFEST, MANIFEST numbers start at 1.
+// A database without CURRENT has no disk tables and MANIFEST number 0.
+// A truncated or corrupted last edit is the tail of an append that did not complete,
+// it was never committed and is ignored. Corruption anywhere else is returned.
+func recoverManifest(fs FS, dbDir string, logger Logger) (*version, int, error) {
+	v := &version{}
+	number, exists, err := readCurrent(fs, dbDir)
+	if err != nil || !exists {
+		return v, 0, err
+	}
+
+	manifestPath := path.Join(dbDir, manifestFileName(number))
+	f, err := fs.Open(manifestPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := info.Size()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		payload, size, err := readWALRecord(r, manifestPath, offset, end)
+		if err == io.EOF {
+			return v, number, nil
+		}
+		corruption, ok := err.(*CorruptionError)
+		if err != nil && !ok {
+			return nil, 0, err
+		}
+
+		if err == nil {
+			ve, err := decodeVersionEdit(payload)
+			if err == nil {
+				err = v.apply(ve)
+			}
+			if err != nil {
+				return nil, 0, &CorruptionError{Path: manifestPath, Offset: offset, Reason: err.Error()}
+			}
+			offset += size
+			continue
+		}
+
+		if size >= 0 && offset+size != end {
+			return nil, 0, corruption
+		}
+		logger.Printf("lsmtree: ignoring incomplete MANIFEST edit: %s", corruption)
+		return v, number, nil
+	}
+}
+
+// logAndApply appends the version edit to the MANIFEST and installs it.
+// The next disk table index and the last sequence number are filled in.
+// Added disk tables must be open, they are referenced by the levels; deleted ones are released.
+// mu must be held.
+func (t *LSMTree) logAndApply(ve *versionEdit) error {
+	ve.nextDiskTableIndex = t.nextDiskTableIndex
+	ve.lastSequence = t.lastSequence
+
+	v := t.version()
+	if err := v.apply(ve); err != nil {
+		return err
+	}
+	// The new disk table files must not be lost once the MANIFEST refers to them.
+	if len(ve.added) > 0 {
+		if err := t.fs.SyncDir(t.dbDir); err != nil {
+			return err
+		}
+	}
+	if err := t.manifest.append(ve); err != nil {
+		return err
+	}
+
+	old := t.levels
+	t.levels = v.levels
+	t.logNumber = v.logNumber
+
+	// A disk table moved to another level is added before it is deleted, so it stays open.
+	for _, added := range ve.added {
+		added.table.ref()
+	}
+	for _, deleted := range ve.deleted {
+		for _, table := range old[deleted.level] {
+			if table.index != deleted.index {
+				continue
+			}
+			if err := table.unref(); err != nil {
+				t.opts.Logger.Printf("lsmtree: closing disk table %d: %s", table.index, err)
+			}
+		}
+	}
+	return nil
+}
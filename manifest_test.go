@@ -0,0 +1,232 @@
+package lsmtree
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+)
+
+// levelsShouldBe checks the disk table indexes of every level, in order.
+func levelsShouldBe(t *testing.T, levels [numLevels][]*tableMeta, want [numLevels][]int) {
+	t.Helper()
+	for level := range levels {
+		var got []int
+		for _, table := range levels[level] {
+			got = append(got, table.index)
+		}
+		if len(got) != len(want[level]) {
+			t.Fatalf("L%d should hold disk tables %v, got %v", level, want[level], got)
+		}
+		for i := range got {
+			if got[i] != want[level][i] {
+				t.Fatalf("L%d should hold disk tables %v, got %v", level, want[level], got)
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	fs, dbDir := NewMemFS(), "."
+
+	v := &version{nextDiskTableIndex: 5, logNumber: 7, lastSequence: 1 << 40}
+	v.levels[0] = []*tableMeta{
+		{index: 4, size: 100, smallest: []byte("b"), largest: []byte("y"), smallestSeq: 31, largestSeq: 40},
+		{index: 3, size: 200, smallest: []byte("a"), largest: []byte("c"), smallestSeq: 21, largestSeq: 30},
+	}
+	v.levels[2] = []*tableMeta{
+		{index: 1, size: 300, smallest: []byte("a"), largest: []byte("m"), smallestSeq: 1, largestSeq: 10},
+		{index: 2, size: 400, smallest: []byte("n"), largest: []byte("z"), smallestSeq: 11, largestSeq: 20},
+	}
+	m, err := createManifest(fs, dbDir, 1, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setCurrent(fs, dbDir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	current := readFile(t, fs, path.Join(dbDir, currentFileName))
+	if string(current) != "MANIFEST-1\n" {
+		t.Fatalf("CURRENT should name MANIFEST-1, got %q", current)
+	}
+
+	// A flush adds the newest L0 disk table.
+	flush := &versionEdit{logNumber: 8, nextDiskTableIndex: 6, lastSequence: 1 << 41}
+	flush.addTable(0, &tableMeta{index: 5, size: 50, smallest: []byte("k"), largest: []byte("l"), smallestSeq: 41, largestSeq: 50})
+	// An L0 compaction merges the two older disk tables into one taking their place.
+	l0Compaction := &versionEdit{logNumber: 8, nextDiskTableIndex: 7, lastSequence: 1 << 41}
+	l0Compaction.deleteTable(0, v.levels[0][0])
+	l0Compaction.deleteTable(0, v.levels[0][1])
+	l0Compaction.addTable(0, &tableMeta{index: 6, size: 250, smallest: []byte("a"), largest: []byte("y"), smallestSeq: 21, largestSeq: 40})
+	// A move from L2 to L3.
+	move := &versionEdit{logNumber: 8, nextDiskTableIndex: 7, lastSequence: 1 << 41}
+	move.deleteTable(2, v.levels[2][1])
+	move.addTable(3, v.levels[2][1])
+	for _, ve := range []*versionEdit{flush, l0Compaction, move} {
+		if err := v.apply(ve); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.append(ve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, number, err := recoverManifest(fs, dbDir, discardLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != 1 {
+		t.Fatalf("MANIFEST-1 should be recovered, got %d", number)
+	}
+	if recovered.nextDiskTableIndex != 7 || recovered.logNumber != 8 || recovered.lastSequence != 1<<41 {
+		t.Fatalf("next disk table index, log number and last sequence should be 7, 8 and %d, got %d, %d and %d",
+			uint64(1<<41), recovered.nextDiskTableIndex, recovered.logNumber, recovered.lastSequence)
+	}
+	want := [numLevels][]int{0: {5, 6}, 2: {1}, 3: {2}}
+	levelsShouldBe(t, v.levels, want)
+	levelsShouldBe(t, recovered.levels, want)
+	table := recovered.levels[0][1]
+	if table.size != 250 || string(table.smallest) != "a" || string(table.largest) != "y" || table.smallestSeq != 21 || table.largestSeq != 40 {
+		t.Fatalf("disk table 6 should be recovered as written, got %+v", table)
+	}
+
+	// An edit deleting a missing disk table cannot be applied.
+	bad := &versionEdit{}
+	bad.deleteTable(1, &tableMeta{index: 1})
+	if err := recovered.apply(bad); err == nil {
+		t.Fatal("deleting a missing disk table should fail")
+	}
+}
+
+func TestManifestCorruption(t *testing.T) {
+	fs, dbDir := NewMemFS(), "."
+
+	v := &version{}
+	v.levels[1] = []*tableMeta{{index: 1, smallest: []byte("a"), largest: []byte("b")}}
+	m, err := createManifest(fs, dbDir, 3, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setCurrent(fs, dbDir, 3); err != nil {
+		t.Fatal(err)
+	}
+	ve := &versionEdit{nextDiskTableIndex: 3}
+	ve.addTable(1, &tableMeta{index: 2, smallest: []byte("c"), largest: []byte("d")})
+	if err := m.append(ve); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := path.Join(dbDir, manifestFileName(3))
+	data := readFile(t, fs, manifestPath)
+
+	// The tail of an incomplete append is ignored.
+	writeFile(t, fs, manifestPath, data[:len(data)-3])
+	recovered, _, err := recoverManifest(fs, dbDir, discardLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	levelsShouldBe(t, recovered.levels, [numLevels][]int{1: {1}})
+
+	// Corruption before the last edit is reported.
+	corrupted := append([]byte{}, data...)
+	corrupted[walRecordHeaderSize] ^= 0xff
+	writeFile(t, fs, manifestPath, corrupted)
+	if _, _, err := recoverManifest(fs, dbDir, discardLogger{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("recovery should fail with ErrCorruption, got %v", err)
+	}
+
+	// So is a corrupted length of an edit before the last one, though the edit seems to run past the end.
+	corrupted = append([]byte{}, data...)
+	corrupted[checksumSize] ^= 0x01
+	writeFile(t, fs, manifestPath, corrupted)
+	if _, _, err := recoverManifest(fs, dbDir, discardLogger{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("recovery should fail with ErrCorruption, got %v", err)
+	}
+
+	writeFile(t, fs, path.Join(dbDir, currentFileName), []byte("metadata.dat\n"))
+	if _, _, err := recoverManifest(fs, dbDir, discardLogger{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("recovery should fail with ErrCorruption, got %v", err)
+	}
+}
+
+func TestRecoverEmptyManifest(t *testing.T) {
+	fs, dbDir := NewMemFS(), "."
+	v, number, err := recoverManifest(fs, dbDir, discardLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != 0 {
+		t.Fatalf("a new database should have no MANIFEST, got %d", number)
+	}
+	if v.nextDiskTableIndex != 0 || v.logNumber != 0 || v.lastSequence != 0 {
+		t.Fatalf("next disk table index, log number and last sequence should be 0, got %d, %d and %d",
+			v.nextDiskTableIndex, v.logNumber, v.lastSequence)
+	}
+	levelsShouldBe(t, v.levels, [numLevels][]int{})
+}
+
+func TestReopenReplacesManifest(t *testing.T) {
+	opts := &Options{MemTableSize: 64, BlockSize: 32, CompactionPicker: &SizeTieredCompactionPicker{}}
+	tree := openTestTree(t, opts)
+	for i := 0; i < 40; i++ {
+		if err := tree.Put([]byte{'a' + byte(i%20)}, []byte(strings.Repeat("v", 8))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("z"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tree.mu.RLock()
+	levels := tree.levels
+	tree.mu.RUnlock()
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		reopened, err := Open(tree.dbDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The disk tables, L0 order included, are recovered from the MANIFEST.
+		var want [numLevels][]int
+		for level, tables := range levels {
+			for _, table := range tables {
+				want[level] = append(want[level], table.index)
+			}
+		}
+		levelsShouldBe(t, reopened.levels, want)
+		valueShouldBe(t, reopened, "a", strings.Repeat("v", 8))
+		valueShouldBe(t, reopened, "z", "1")
+		if err := reopened.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := tree.fs.List(tree.dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifests []string
+	for _, name := range names {
+		if strings.HasPrefix(name, manifestFileNamePrefix) {
+			manifests = append(manifests, name)
+		}
+	}
+	if len(manifests) != 1 || manifests[0] != manifestFileName(3) {
+		t.Fatalf("only %s should be left, got %v", manifestFileName(3), manifests)
+	}
+}
@@ -0,0 +1,384 @@
+package lsmtree
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory FS, so tests run without touching the disk.
+// It remembers what was synced, CrashClone returns what a crash would leave behind.
+// It is safe for concurrent use.
+type MemFS struct {
+	// mu protects the fields below, not the content of the files.
+	mu sync.Mutex
+	// dirs are the existing directories, files the existing files, both by cleaned path.
+	dirs  map[string]bool
+	files map[string]*memNode
+	// locked are the files locked by Lock.
+	locked map[string]bool
+}
+
+// memNode is the content of a file of a MemFS, shared by the memFiles opening it.
+type memNode struct {
+	mu   sync.RWMutex
+	data []byte
+	// synced is the content as of the last Sync.
+	synced []byte
+	// modTime is the time of the last write.
+	modTime time.Time
+}
+
+// errReadOnly is returned by writes to a memFile opened for reading only.
+var errReadOnly = errors.New("file opened for reading only")
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		dirs:   map[string]bool{".": true, "/": true},
+		files:  make(map[string]*memNode),
+		locked: make(map[string]bool),
+	}
+}
+
+// CrashClone returns a copy of the MemFS as a crash would leave it:
+// files hold what was last synced, unsynced writes are lost.
+// Creations, renames and removals of files are kept whether or not their directory was synced.
+func (fs *MemFS) CrashClone() *MemFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	clone := NewMemFS()
+	for dir := range fs.dirs {
+		clone.dirs[dir] = true
+	}
+	for name, node := range fs.files {
+		node.mu.RLock()
+		clone.files[name] = &memNode{
+			data:    append([]byte{}, node.synced...),
+			synced:  append([]byte{}, node.synced...),
+			modTime: node.modTime,
+		}
+		node.mu.RUnlock()
+	}
+	return clone
+}
+
+// pathError returns the error of the operation on the named file, like the os package does.
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Create creates the named file for reading and writing, truncating it if it exists.
+func (fs *MemFS) Create(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if !fs.dirs[path.Dir(name)] {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	if fs.dirs[name] {
+		return nil, pathError("open", name, errors.New("is a directory"))
+	}
+	node, ok := fs.files[name]
+	if !ok {
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+	node.mu.Lock()
+	node.data = nil
+	node.mu.Unlock()
+	return &memFile{name: name, node: node}, nil
+}
+
+// Open opens the named file for reading.
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.open(name, true)
+}
+
+// OpenReadWrite opens the existing named file for reading and writing, at offset 0.
+func (fs *MemFS) OpenReadWrite(name string) (File, error) {
+	return fs.open(name, false)
+}
+
+// open opens the existing named file.
+func (fs *MemFS) open(name string, readOnly bool) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	return &memFile{name: name, node: node, readOnly: readOnly}, nil
+}
+
+// Rename renames a file, replacing newname if it exists.
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	node, ok := fs.files[oldname]
+	if !ok {
+		return pathError("rename", oldname, os.ErrNotExist)
+	}
+	if !fs.dirs[path.Dir(newname)] {
+		return pathError("rename", newname, os.ErrNotExist)
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+// Remove removes the named file. Open memFiles of the file keep working.
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := fs.files[name]; !ok {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// List returns the names of the files and directories in the directory, sorted.
+func (fs *MemFS) List(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = path.Clean(dir)
+	if !fs.dirs[dir] {
+		return nil, pathError("open", dir, os.ErrNotExist)
+	}
+	var names []string
+	for name := range fs.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MkdirAll creates the directory and its missing parents.
+func (fs *MemFS) MkdirAll(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for dir = path.Clean(dir); !fs.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return pathError("mkdir", dir, errors.New("not a directory"))
+		}
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+// SyncDir does nothing, directory changes are never lost by a MemFS.
+func (fs *MemFS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.dirs[path.Clean(dir)] {
+		return pathError("open", dir, os.ErrNotExist)
+	}
+	return nil
+}
+
+// Lock takes an exclusive lock on the named file, creating it if needed.
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if !fs.dirs[path.Dir(name)] {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	if fs.locked[name] {
+		return nil, ErrLocked
+	}
+	if _, ok := fs.files[name]; !ok {
+		fs.files[name] = &memNode{modTime: time.Now()}
+	}
+	fs.locked[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+// memLock is a lock taken by MemFS.Lock.
+type memLock struct {
+	fs       *MemFS
+	name     string
+	released bool
+}
+
+// Close releases the lock, releasing it twice is a no-op.
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	if !l.released {
+		l.released = true
+		delete(l.fs.locked, l.name)
+	}
+	return nil
+}
+
+// memFile is an open file of a MemFS.
+type memFile struct {
+	name     string
+	node     *memNode
+	offset   int64
+	readOnly bool
+	closed   bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, pathError("read", f.name, errors.New("negative offset"))
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.readOnly {
+		return 0, pathError("write", f.name, errReadOnly)
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, errors.New("negative offset"))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	return &memFileInfo{name: path.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	f.node.synced = append([]byte{}, f.node.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.readOnly {
+		return pathError("truncate", f.name, errReadOnly)
+	}
+	if size < 0 {
+		return pathError("truncate", f.name, errors.New("negative size"))
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// memFileInfo describes a file of a MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -1,41 +1,64 @@
 package lsmtree
 
 import (
+	"bytes"
 	"lsmtree/skiplist"
 )
 
 // MemTable. In memory structure for storing key-value pairs. Using bst to store for now.
+// Records are stored under their internal key, so every version of a key is kept.
+// The value of a tombstone is <nil>.
 type memTable struct {
 	// tree *binarytree.Tree
 	list *skiplist.SkipList
 	keys int
+	// size is the approximate number of bytes written to the memTable.
+	size int
+	// lastSequence is the largest sequence number written to the memTable.
+	lastSequence uint64
+	// walNumber is the WAL segment holding the records of the memTable.
+	walNumber int
 }
 
 // newMemTable creates a new memTable.
 func newMemTable() *memTable {
-	return &memTable{list: skiplist.NewSkipList()}
+	return &memTable{list: skiplist.NewSkipListWithCompare(compareInternalKeys)}
 }
 
-// Put inserts a key-value pair into the memTable.
-func (mt *memTable) put(key, value []byte) error {
-	exists := mt.list.Put(key, value)
+// put inserts a key-value pair written with the sequence number into the memTable.
+func (mt *memTable) put(seq uint64, key, value []byte) error {
+	return mt.set(seq, key, value, recordTypePut)
+}
+
+// set inserts a record of the given type written with the sequence number into the memTable.
+func (mt *memTable) set(seq uint64, key, value []byte, rt recordType) error {
+	if rt == recordTypeDelete {
+		value = nil
+	} else if value == nil {
+		value = []byte{}
+	}
+
+	exists := mt.list.Put(makeInternalKey(key, seq, rt), value)
 	if !exists {
 		mt.keys++
 	}
+	mt.size += len(key) + len(value)
+	if seq > mt.lastSequence {
+		mt.lastSequence = seq
+	}
 
 	return nil
 }
 
-// Get returns the value for the given key.
-// Returns <nil> for deleted keys.
-func (mt *memTable) get(key []byte) ([]byte, bool) {
-	return mt.list.Get(key)
-}
-
-// clear clears the memTable.
-func (mt *memTable) clear() {
-	mt.list.Clear()
-	mt.keys = 0
+// get returns the value and internal key of the newest version of the key visible at the sequence number.
+// Returns <nil> value for deleted keys.
+func (mt *memTable) get(key []byte, seq uint64) ([]byte, []byte, bool) {
+	it := mt.list.Iterator()
+	it.Seek(seekKey(key, seq))
+	if !it.Valid() || !bytes.Equal(extractUserKey(it.Key()), key) {
+		return nil, nil, false
+	}
+	return it.Value(), it.Key(), true
 }
 
 // memTableIterator is an iterator for the memTable.
@@ -48,12 +71,57 @@ func (mt *memTable) iterator() *memTableIterator {
 	return &memTableIterator{it: mt.list.Iterator()}
 }
 
-// next returns the next key-value pair in the memTable.
-func (mti *memTableIterator) next() ([]byte, []byte, error) {
-	return mti.it.Next()
+// seek moves the iterator to the first internal key greater than or equal to key.
+func (mti *memTableIterator) seek(key []byte) error {
+	mti.it.Seek(key)
+	return nil
+}
+
+// seekForPrev moves the iterator to the last internal key less than or equal to key.
+func (mti *memTableIterator) seekForPrev(key []byte) error {
+	mti.it.SeekForPrev(key)
+	return nil
+}
+
+// seekToLast moves the iterator to the last key in the memTable.
+func (mti *memTableIterator) seekToLast() error {
+	mti.it.SeekToLast()
+	return nil
 }
 
-// hasNext returns true if there are more key-value pairs in the memTable.
-func (mti *memTableIterator) hasNext() bool {
-	return mti.it.HasNext()
+// next moves the iterator to the next key-value pair in the memTable.
+func (mti *memTableIterator) next() error {
+	_, _, err := mti.it.Next()
+	return err
+}
+
+// prev moves the iterator to the previous key-value pair in the memTable.
+func (mti *memTableIterator) prev() error {
+	mti.it.Prev()
+	return nil
+}
+
+// valid returns true if the iterator is positioned at a key-value pair.
+func (mti *memTableIterator) valid() bool {
+	return mti.it.Valid()
+}
+
+// key returns the internal key at the current position.
+func (mti *memTableIterator) key() []byte {
+	return mti.it.Key()
+}
+
+// value returns the value at the current position, <nil> for tombstones.
+func (mti *memTableIterator) value() []byte {
+	return mti.it.Value()
+}
+
+// recordType returns the record type at the current position.
+func (mti *memTableIterator) recordType() recordType {
+	return internalKeyType(mti.it.Key())
+}
+
+// close releases the iterator.
+func (mti *memTableIterator) close() error {
+	return nil
 }
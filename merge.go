@@ -2,187 +2,263 @@ package lsmtree
 
 import (
 	"bytes"
-	"fmt"
-	"io"
-	"os"
-	"path"
-	"strconv"
+	"container/heap"
+	"sort"
 )
 
-const (
-	// mergePrefix is prefix of merging file
-	mergePrefix = "merge_"
-)
+// recordWriter is where mergeDiskTables writes its output.
+type recordWriter interface {
+	write(key, value []byte, rt recordType) error
+}
 
-func mergeDiskTables(dbDir string, db1, db2, sparseKeyDistance int) error {
-	fmt.Printf("mergeDiskTables: db1=%d, db2=%d\n", db1, db2)
-	prefix1 := strconv.Itoa(db1) + "_"
-	path1 := path.Join(dbDir, prefix1+diskTableDataFileNamePrefix)
-	dfi1, err := newDataFileIterator(path1)
-	if err != nil {
-		return err
+// mergeDiskTables merges the disk tables into w in one pass.
+// indexes are ordered from newest to oldest.
+// snapshots are the sequence numbers of the open snapshots, ascending. Of the records of a key,
+// the newest one and the newest one visible to each snapshot are kept, the other versions are dropped.
+// Tombstones are carried forward so they keep shadowing the key in older tables.
+// The inputs are always verified against their checksums.
+func mergeDiskTables(fs FS, dbDir string, indexes []int, snapshots []uint64, w recordWriter) error {
+	var iters []internalIterator
+	for _, index := range indexes {
+		dti, err := newDiskTableIterator(fs, dbDir, index, true)
+		if err != nil {
+			closeIterators(iters)
+			return err
+		}
+		iters = append(iters, dti)
 	}
-	defer dfi1.close()
 
-	prefix2 := strconv.Itoa(db2) + "_"
-	path2 := path.Join(dbDir, prefix2+diskTableDataFileNamePrefix)
-	dfi2, err := newDataFileIterator(path2)
-	if err != nil {
+	mi := newMergingIterator(iters, maxSequenceNumber)
+	mi.allVersions = true
+	defer mi.close()
+
+	if err := mi.seek(seekKey(nil, maxSequenceNumber)); err != nil {
 		return err
 	}
-	defer dfi2.close()
-
-	w, err := newDiskTableWriter(dbDir, mergePrefix+prefix2, sparseKeyDistance)
-	if err != nil {
-		return nil
+	// The records of a key come newest first. A record is hidden by the previous one
+	// if no snapshot sees one without the other.
+	var lastUserKey []byte
+	lastStripe := -1
+	for mi.valid() {
+		userKey := extractUserKey(mi.key())
+		stripe := snapshotStripe(snapshots, internalKeySequence(mi.key()))
+		if stripe != lastStripe || !bytes.Equal(userKey, lastUserKey) {
+			if err := w.write(mi.key(), mi.value(), mi.recordType()); err != nil {
+				return err
+			}
+		}
+		lastUserKey, lastStripe = userKey, stripe
+		if err := mi.next(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// merge data
-	if err := merge(dfi1, dfi2, w); err != nil {
-		return nil
-	}
+// snapshotStripe returns the index of the oldest snapshot that sees the sequence number,
+// len(snapshots) if only reads after every snapshot see it.
+// Records of a key in the same stripe are seen by the same snapshots.
+func snapshotStripe(snapshots []uint64, seq uint64) int {
+	return sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+}
 
-	if err := dfi1.close(); err != nil {
-		return err
-	}
-	if err := dfi2.close(); err != nil {
-		return err
-	}
+// mergingIterator merges any number of sources sorted by internal key with a heap.
+// Each user key is reported once with its newest record visible at the sequence number,
+// tombstones are not hidden.
+// It moves in the direction it was positioned in: forward after seek,
+// backward after seekForPrev or seekToLast.
+type mergingIterator struct {
+	// iters are ordered from newest to oldest.
+	iters []internalIterator
+	heap  iteratorHeap
+	// seq is the largest visible sequence number, newer records are skipped.
+	seq uint64
+	// allVersions reports every record, in internal key order, instead of
+	// the newest visible record of each user key. seq is ignored.
+	allVersions bool
 
-	// delete db1 and db2
-	if err := deleteDiskTables(dbDir, prefix1); err != nil {
-		return err
-	}
-	if err := deleteDiskTables(dbDir, prefix2); err != nil {
-		return err
-	}
+	k, v []byte
+	rt   recordType
+	ok   bool
+}
 
-	// rename merge file to db2
-	if err := renameDiskTables(dbDir, mergePrefix+prefix2, prefix2); err != nil {
-		return err
-	}
+// newMergingIterator returns an unpositioned mergingIterator over iters, ordered from newest to oldest,
+// seeing the records up to the sequence number.
+func newMergingIterator(iters []internalIterator, seq uint64) *mergingIterator {
+	return &mergingIterator{iters: iters, seq: seq}
+}
 
-	return nil
+// seek moves to the first internal key greater than or equal to key.
+func (mi *mergingIterator) seek(key []byte) error {
+	return mi.position(false, func(iter internalIterator) error {
+		return iter.seek(key)
+	})
 }
 
-// merge two dataFileIterator to the writer
-func merge(dfi1, dfi2 *dataFileIterator, w *diskTableWriter) error {
-	var key1, key2, value1, value2 []byte
-	var err error
-	for {
-		if key1 == nil && dfi1.hasNext() {
-			key1, value1, err = dfi1.next()
-			if err != nil {
-				return err
-			}
-		}
+// seekForPrev moves to the last internal key less than or equal to key.
+func (mi *mergingIterator) seekForPrev(key []byte) error {
+	return mi.position(true, func(iter internalIterator) error {
+		return iter.seekForPrev(key)
+	})
+}
 
-		if key2 == nil && dfi2.hasNext() {
-			key2, value2, err = dfi2.next()
-			if err != nil {
-				return err
-			}
-		}
+// seekToLast moves to the last key.
+func (mi *mergingIterator) seekToLast() error {
+	return mi.position(true, func(iter internalIterator) error {
+		return iter.seekToLast()
+	})
+}
 
-		if key1 == nil && key2 == nil && !dfi1.hasNext() && !dfi2.hasNext() {
-			return nil
+// position positions every source with seek and rebuilds the heap.
+// reverse tells the direction of the following calls to next.
+func (mi *mergingIterator) position(reverse bool, seek func(iter internalIterator) error) error {
+	mi.heap.reverse = reverse
+	mi.heap.items = mi.heap.items[:0]
+	for i, iter := range mi.iters {
+		if err := seek(iter); err != nil {
+			mi.ok = false
+			return err
 		}
+		if iter.valid() {
+			mi.heap.items = append(mi.heap.items, iteratorHeapItem{iter: iter, age: i})
+		}
+	}
+	heap.Init(&mi.heap)
+
+	return mi.next()
+}
+
+// next moves to the next user key in the direction of the last positioning
+// with a record visible at the sequence number.
+// Every other record of the current user key is skipped.
+// With allVersions, it moves to the next record.
+func (mi *mergingIterator) next() error {
+	if mi.allVersions && mi.heap.Len() > 0 {
+		item := mi.heap.items[0]
+		mi.k, mi.v, mi.rt = item.iter.key(), item.iter.value(), item.iter.recordType()
+		mi.ok = true
+		return mi.advance(item.iter)
+	}
 
-		if key1 != nil && key2 != nil {
-			if bytes.Compare(key1, key2) < 0 {
-				// key1 < key2, write key1, value1
-				err := w.write(key1, value1)
-				if err != nil {
-					return err
-				}
-				key1, value1 = nil, nil
-			} else if bytes.Compare(key1, key2) > 0 {
-				// key1 > key2, write key2, value2
-				err := w.write(key2, value2)
-				if err != nil {
-					return err
-				}
-				key2, value2 = nil, nil
-			} else {
-				// key1 == key2, write key2, value2
-				err := w.write(key2, value2)
-				if err != nil {
-					return err
-				}
-				key1, value1 = nil, nil
-				key2, value2 = nil, nil
+	for mi.heap.Len() > 0 {
+		// Forward, the records of a user key come newest first, backward oldest first.
+		// The newest visible one is kept.
+		userKey := extractUserKey(mi.heap.items[0].iter.key())
+		found := false
+		for mi.heap.Len() > 0 {
+			item := mi.heap.items[0]
+			key := item.iter.key()
+			if !bytes.Equal(extractUserKey(key), userKey) {
+				break
 			}
-		} else if key1 != nil {
-			if err := w.write(key1, value1); err != nil {
-				return err
+			seq := internalKeySequence(key)
+			if seq <= mi.seq && (!found || mi.heap.reverse && seq > internalKeySequence(mi.k)) {
+				mi.k, mi.v, mi.rt = key, item.iter.value(), item.iter.recordType()
+				found = true
 			}
-			key1, value1 = nil, nil
-		} else if key2 != nil {
-			if err := w.write(key2, value2); err != nil {
+			if err := mi.advance(item.iter); err != nil {
 				return err
 			}
-			key2, value2 = nil, nil
+		}
+		if found {
+			mi.ok = true
+			return nil
 		}
 	}
-}
 
-// dataFileIterator is an iterator for diskTable data file.
-type dataFileIterator struct {
-	file  *os.File
-	key   []byte
-	value []byte
-	eof   bool
+	mi.ok = false
+	return nil
 }
 
-// newDataFileIterator creates a new dataFileIterator.
-func newDataFileIterator(path string) (*dataFileIterator, error) {
-	file, err := os.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		return nil, err
+// advance steps iter, the top of the heap, and restores the heap.
+func (mi *mergingIterator) advance(iter internalIterator) error {
+	if err := mi.step(iter); err != nil {
+		mi.ok = false
+		return err
 	}
+	if iter.valid() {
+		heap.Fix(&mi.heap, 0)
+	} else {
+		heap.Pop(&mi.heap)
+	}
+	return nil
+}
 
-	key, value, err := decode(file)
-	if err != nil && err != io.EOF {
-		return nil, err
+// step moves iter one key in the direction of the heap.
+func (mi *mergingIterator) step(iter internalIterator) error {
+	if mi.heap.reverse {
+		return iter.prev()
 	}
+	return iter.next()
+}
 
-	eof := err == io.EOF
+func (mi *mergingIterator) valid() bool {
+	return mi.ok
+}
 
-	return &dataFileIterator{
-		file:  file,
-		key:   key,
-		value: value,
-		eof:   eof,
-	}, nil
+// key returns the internal key at the current position.
+func (mi *mergingIterator) key() []byte {
+	return mi.k
 }
 
-// next returns next Key-Value pair of dataFileIterator
-func (dfi *dataFileIterator) next() ([]byte, []byte, error) {
-	if dfi.eof {
-		return dfi.key, dfi.value, nil
-	}
+func (mi *mergingIterator) value() []byte {
+	return mi.v
+}
+
+func (mi *mergingIterator) recordType() recordType {
+	return mi.rt
+}
 
-	key := dfi.key
-	value := dfi.value
+// close closes all sources, returns the first error.
+func (mi *mergingIterator) close() error {
+	mi.ok = false
+	return closeIterators(mi.iters)
+}
 
-	nextKey, nextValue, err := decode(dfi.file)
-	if err != nil && err != io.EOF {
-		return nil, nil, err
+// closeIterators closes all iterators, returns the first error.
+func closeIterators(iters []internalIterator) error {
+	var firstErr error
+	for _, iter := range iters {
+		if err := iter.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
+}
+
+// iteratorHeapItem is an internalIterator with its age, lower is newer.
+type iteratorHeapItem struct {
+	iter internalIterator
+	age  int
+}
 
-	dfi.eof = err == io.EOF
-	dfi.key = nextKey
-	dfi.value = nextValue
+// iteratorHeap is a min-heap ordered by internal key, then by age.
+// A reverse heap is a max-heap on internal key, still ordered by age for equal keys.
+type iteratorHeap struct {
+	items   []iteratorHeapItem
+	reverse bool
+}
+
+func (h *iteratorHeap) Len() int { return len(h.items) }
 
-	return key, value, nil
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := compareInternalKeys(h.items[i].iter.key(), h.items[j].iter.key())
+	if cmp != 0 {
+		return (cmp < 0) != h.reverse
+	}
+	return h.items[i].age < h.items[j].age
 }
 
-// hasNext returns true if data has next
-func (dti *dataFileIterator) hasNext() bool {
-	return !dti.eof
+func (h *iteratorHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *iteratorHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(iteratorHeapItem))
 }
 
-// close closes dataFileIterator
-func (dti *dataFileIterator) close() error {
-	return dti.file.Close()
+func (h *iteratorHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
 }
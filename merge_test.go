@@ -1,13 +1,15 @@
 package lsmtree
 
 import (
-	"os"
-	"path"
-	"strconv"
+	"fmt"
 	"testing"
 )
 
-func TestDataFileIterator(t *testing.T) {
+// keysPerDiskTable is the number of test elements flushed to each disk table
+// with a MemTableSize of 16.
+const keysPerDiskTable = 4
+
+func TestDiskTableEntries(t *testing.T) {
 	type Element struct {
 		Key   []byte
 		Value []byte
@@ -26,31 +28,21 @@ func TestDataFileIterator(t *testing.T) {
 		{Key: []byte("11"), Value: []byte("Eleven")},
 	}
 
-	dir := os.TempDir()
-	tree := NewLSMTree(dir, 2)
-	t.Logf("Tmp dir: %s", dir)
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 16, L0CompactionTrigger: 4, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, elem := range elems {
 		tree.Put(elem.Key, elem.Value)
 	}
-
-	prefix := strconv.Itoa(0) + "_"
-
-	dfi, err := newDataFileIterator(path.Join(dir, prefix+diskTableDataFileNamePrefix))
-	if err != nil {
+	if err := tree.Flush(); err != nil {
 		t.Fatal(err)
 	}
 
-	count := 0
-	for dfi.hasNext() {
-		key, value, err := dfi.next()
-		if err != nil {
-			t.Fatal(err)
-		}
-		count++
-		t.Logf("Key: %s, Value: %s", key, value)
-	}
-	if count != memTableThreshold {
-		t.Fatal("dataFileIterator Expected", memTableThreshold, "entries, got", count)
+	count := countDiskTableEntries(t, fs, dir, 0)
+	if count != keysPerDiskTable {
+		t.Fatal("diskTableIterator Expected", keysPerDiskTable, "entries, got", count)
 	}
 }
 
@@ -73,38 +65,56 @@ func TestMergeDiskTable(t *testing.T) {
 		{Key: []byte("11"), Value: []byte("Eleven")},
 	}
 
-	dir := os.TempDir()
-	tree := NewLSMTree(dir, 2)
-	t.Logf("Tmp dir: %s", dir)
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 16, L0CompactionTrigger: 4, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, elem := range elems {
 		tree.Put(elem.Key, elem.Value)
 	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
 
-	err := mergeDiskTables(dir, 0, 1, 2)
-
+	w, err := newSSTWriter(fs, diskTablePath(dir, 10), 32, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mergeDiskTables(fs, dir, []int{1, 0}, nil, w)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
 
-	prefix := strconv.Itoa(1) + "_"
+	count := countDiskTableEntries(t, fs, dir, 10)
+	if count != 2*keysPerDiskTable {
+		t.Fatal("diskTableIterator Expected", 2*keysPerDiskTable, "entries, got", count)
+	}
+}
 
-	dfi, err := newDataFileIterator(path.Join(dir, prefix+diskTableDataFileNamePrefix))
+// countDiskTableEntries returns the number of records in the disk table.
+func countDiskTableEntries(t *testing.T, fs FS, dir string, index int) int {
+	dti, err := newDiskTableIterator(fs, dir, index, true)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer dti.close()
 
 	count := 0
-	for dfi.hasNext() {
-		key, value, err := dfi.next()
-		if err != nil {
+	if err := dti.seek(seekKey(nil, maxSequenceNumber)); err != nil {
+		t.Fatal(err)
+	}
+	for dti.valid() {
+		t.Logf("Key: %s, Value: %s", dti.key(), dti.value())
+		count++
+		if err := dti.next(); err != nil {
 			t.Fatal(err)
 		}
-		count++
-		t.Logf("Key: %s, Value: %s", key, value)
-	}
-	if count != 2*memTableThreshold {
-		t.Fatal("dataFileIterator Expected", memTableThreshold, "entries, got", count)
 	}
+	return count
 }
 
 func TestPutMerge(t *testing.T) {
@@ -127,36 +137,244 @@ func TestPutMerge(t *testing.T) {
 		{Key: []byte("12"), Value: []byte("Twelve")},
 	}
 
-	dir := os.TempDir()
-	tree := NewLSMTree(dir, 2)
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 16, L0CompactionTrigger: 4, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("Tmp dir: %s", dir)
 	for _, elem := range elems {
 		tree.Put(elem.Key, elem.Value)
 	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordCollector is a recordWriter keeping the internal keys written.
+type recordCollector struct {
+	keys [][]byte
+}
+
+func (rc *recordCollector) write(key, value []byte, rt recordType) error {
+	rc.keys = append(rc.keys, key)
+	return nil
+}
+
+func TestMergeDiskTablesSnapshots(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+
+	// Versions 1 to 6 of a, split between two disk tables, and a single version of b.
+	older, newer := newMemTable(), newMemTable()
+	for seq := uint64(1); seq <= 3; seq++ {
+		older.put(seq, []byte("a"), []byte(fmt.Sprintf("a%d", seq)))
+	}
+	for seq := uint64(4); seq <= 6; seq++ {
+		newer.put(seq, []byte("a"), []byte(fmt.Sprintf("a%d", seq)))
+	}
+	newer.put(7, []byte("b"), []byte("b7"))
+	for index, mt := range []*memTable{older, newer} {
+		if _, err := createDiskTable(fs, mt, dir, index, 32, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		snapshots []uint64
+		// keys are the user keys and sequence numbers of the records kept.
+		keys []string
+	}{
+		{nil, []string{"a6", "b7"}},
+		{[]uint64{2, 4}, []string{"a6", "a4", "a2", "b7"}},
+		{[]uint64{0, 6, 7}, []string{"a6", "b7"}},
+		{[]uint64{3, 3}, []string{"a6", "a3", "b7"}},
+	}
+	for _, test := range tests {
+		rc := &recordCollector{}
+		if err := mergeDiskTables(fs, dir, []int{1, 0}, test.snapshots, rc); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, key := range rc.keys {
+			keys = append(keys, fmt.Sprintf("%s%d", extractUserKey(key), internalKeySequence(key)))
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.keys) {
+			t.Fatalf("merge with snapshots %v should keep %v, got %v", test.snapshots, test.keys, keys)
+		}
+	}
+}
+
+func TestMergingIterator(t *testing.T) {
+	newest, middle, oldest := newMemTable(), newMemTable(), newMemTable()
+	oldest.put(1, []byte("a"), []byte("old a"))
+	oldest.put(2, []byte("b"), []byte("old b"))
+	oldest.put(3, []byte("d"), []byte("old d"))
+	middle.put(4, []byte("b"), []byte("middle b"))
+	middle.set(5, []byte("c"), nil, recordTypeDelete)
+	newest.put(6, []byte("c"), []byte("new c"))
+	newest.set(7, []byte("d"), nil, recordTypeDelete)
+	newest.put(8, []byte("e"), []byte("new e"))
+	newest.put(9, []byte("e"), []byte("newer e"))
+
+	type record struct {
+		key, value string
+		rt         recordType
+	}
+	want := []record{
+		{"a", "old a", recordTypePut},
+		{"b", "middle b", recordTypePut},
+		{"c", "new c", recordTypePut},
+		{"d", "", recordTypeDelete},
+		{"e", "newer e", recordTypePut},
+	}
+
+	mi := newMergingIterator([]internalIterator{newest.iterator(), middle.iterator(), oldest.iterator()}, maxSequenceNumber)
+	defer mi.close()
+
+	if err := mi.seek(seekKey(nil, maxSequenceNumber)); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range want {
+		if !mi.valid() || string(extractUserKey(mi.key())) != r.key || string(mi.value()) != r.value || mi.recordType() != r.rt {
+			t.Fatalf("mergingIterator should be at %+v, got %s %s %d", r, extractUserKey(mi.key()), mi.value(), mi.recordType())
+		}
+		if err := mi.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mi.valid() {
+		t.Fatalf("mergingIterator should be exhausted, got %s", mi.key())
+	}
+
+	if err := mi.seekForPrev(makeInternalKey([]byte("cc"), 0, recordTypeDelete)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i >= 0; i-- {
+		if !mi.valid() || string(extractUserKey(mi.key())) != want[i].key || string(mi.value()) != want[i].value {
+			t.Fatalf("reverse mergingIterator should be at %+v, got %s %s", want[i], extractUserKey(mi.key()), mi.value())
+		}
+		if err := mi.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mi.valid() {
+		t.Fatalf("reverse mergingIterator should be exhausted, got %s", extractUserKey(mi.key()))
+	}
+
+	// Records newer than the sequence number are not visible, in both directions.
+	old := newMergingIterator([]internalIterator{newest.iterator(), middle.iterator(), oldest.iterator()}, 5)
+	defer old.close()
+	wantOld := []record{
+		{"a", "old a", recordTypePut},
+		{"b", "middle b", recordTypePut},
+		{"c", "", recordTypeDelete},
+		{"d", "old d", recordTypePut},
+	}
+	if err := old.seek(seekKey(nil, maxSequenceNumber)); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range wantOld {
+		if !old.valid() || string(extractUserKey(old.key())) != r.key || string(old.value()) != r.value || old.recordType() != r.rt {
+			t.Fatalf("mergingIterator at sequence 5 should be at %+v, got %s %s %d", r, extractUserKey(old.key()), old.value(), old.recordType())
+		}
+		if err := old.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old.valid() {
+		t.Fatalf("mergingIterator at sequence 5 should be exhausted, got %s", extractUserKey(old.key()))
+	}
+	if err := old.seekToLast(); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(wantOld) - 1; i >= 0; i-- {
+		if !old.valid() || string(extractUserKey(old.key())) != wantOld[i].key || string(old.value()) != wantOld[i].value {
+			t.Fatalf("reverse mergingIterator at sequence 5 should be at %+v, got %s %s", wantOld[i], extractUserKey(old.key()), old.value())
+		}
+		if err := old.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old.valid() {
+		t.Fatalf("reverse mergingIterator at sequence 5 should be exhausted, got %s", extractUserKey(old.key()))
+	}
+}
 
-	// err := mergeDiskTables(dir, 0, 1, 2)
+// mergeBenchmarkTables is the number of disk tables merged by the merge benchmarks.
+const mergeBenchmarkTables = 8
 
-	// if err != nil {
-	// 	t.Fatal(err)
-	// }
+// createMergeBenchmarkTables writes disk tables 0 to mergeBenchmarkTables-1 with interleaved keys.
+func createMergeBenchmarkTables(b *testing.B) (FS, string) {
+	fs, dir := NewMemFS(), "db"
+	if err := fs.MkdirAll(dir); err != nil {
+		b.Fatal(err)
+	}
+	for index := 0; index < mergeBenchmarkTables; index++ {
+		mt := newMemTable()
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("%06d", i*mergeBenchmarkTables+index)
+			mt.put(uint64(i+1), []byte(key), []byte("value"+key))
+		}
+		if _, err := createDiskTable(fs, mt, dir, index, 1024, 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return fs, dir
+}
 
-	// prefix := strconv.Itoa(1) + "_"
+// mergeIntoDiskTable merges the disk tables, newest first, into a new disk table.
+// Returns the size of the new disk table.
+func mergeIntoDiskTable(fs FS, dir string, indexes []int, index int) (int, error) {
+	w, err := newSSTWriter(fs, diskTablePath(dir, index), 1024, 10)
+	if err != nil {
+		return 0, err
+	}
+	err = mergeDiskTables(fs, dir, indexes, nil, w)
+	if closeErr := w.close(); err == nil {
+		err = closeErr
+	}
+	return w.size(), err
+}
+
+// BenchmarkMergeDiskTablesPairwise merges the disk tables two at a time,
+// rewriting the merged data once per input table.
+func BenchmarkMergeDiskTablesPairwise(b *testing.B) {
+	fs, dir := createMergeBenchmarkTables(b)
+
+	written := 0
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		acc := 0
+		for index := 1; index < mergeBenchmarkTables; index++ {
+			out := mergeBenchmarkTables + index
+			size, err := mergeIntoDiskTable(fs, dir, []int{index, acc}, out)
+			if err != nil {
+				b.Fatal(err)
+			}
+			written += size
+			acc = out
+		}
+	}
+	b.ReportMetric(float64(written)/float64(b.N), "bytes-written/op")
+}
 
-	// dfi, err := newDataFileIterator(path.Join(dir, prefix+diskTableDataFileNamePrefix))
-	// if err != nil {
-	// 	t.Fatal(err)
-	// }
+// BenchmarkMergeDiskTablesKWay merges all disk tables in one pass.
+func BenchmarkMergeDiskTablesKWay(b *testing.B) {
+	fs, dir := createMergeBenchmarkTables(b)
+
+	indexes := make([]int, mergeBenchmarkTables)
+	for i := range indexes {
+		indexes[i] = mergeBenchmarkTables - 1 - i
+	}
 
-	// count := 0
-	// for dfi.hasNext() {
-	// 	key, value, err := dfi.next()
-	// 	if err != nil {
-	// 		t.Fatal(err)
-	// 	}
-	// 	count++
-	// 	t.Logf("Key: %s, Value: %s", key, value)
-	// }
-	// if count != 2*memTableThreshold {
-	// 	t.Fatal("dataFileIterator Expected", memTableThreshold, "entries, got", count)
-	// }
+	written := 0
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		size, err := mergeIntoDiskTable(fs, dir, indexes, mergeBenchmarkTables)
+		if err != nil {
+			b.Fatal(err)
+		}
+		written += size
+	}
+	b.ReportMetric(float64(written)/float64(b.N), "bytes-written/op")
 }
@@ -0,0 +1,47 @@
+package lsmtree
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// removeObsoleteFiles deletes the files a crash may leave behind: disk tables missing from the
+// version, partially written or written by a flush or compaction that was not installed, or
+// left over after a compaction was installed; MANIFEST files other than the live one and
+// a temporary CURRENT or options file. WAL segments are handled by Open.
+func removeObsoleteFiles(fs FS, dbDir string, v *version, manifestNumber int, logger Logger) error {
+	live := make(map[int]bool)
+	for _, tables := range v.levels {
+		for _, table := range tables {
+			live[table.index] = true
+		}
+	}
+
+	names, err := fs.List(dbDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		obsolete := false
+		switch {
+		case name == currentTempFileName || name == optionsTempFileName:
+			obsolete = true
+		case strings.HasPrefix(name, manifestFileNamePrefix):
+			number, err := strconv.Atoi(strings.TrimPrefix(name, manifestFileNamePrefix))
+			obsolete = err == nil && number != manifestNumber
+		case strings.HasSuffix(name, diskTableFileNameSuffix):
+			index, err := strconv.Atoi(strings.TrimSuffix(name, diskTableFileNameSuffix))
+			obsolete = err == nil && !live[index]
+		}
+		if !obsolete {
+			continue
+		}
+
+		logger.Printf("lsmtree: removing obsolete file %s", name)
+		if err := fs.Remove(path.Join(dbDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
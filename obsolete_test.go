@@ -0,0 +1,251 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// crashCopy is the state of a database left by a crash.
+type crashCopy struct {
+	step string
+	fs   *MemFS
+	// want is the value of every key written so far, "" for a deleted key.
+	want map[string]string
+}
+
+// TestCrashRecovery simulates a crash at every crash point of Open, flushes and compactions
+// while writing, then checks that every crashed database opens with all its writes and
+// without obsolete files.
+func TestCrashRecovery(t *testing.T) {
+	fs, dbDir := NewMemFS(), "db"
+
+	// The memTable is only flushed by Flush, so no write runs while a crash point is reached.
+	opts := Options{
+		MemTableSize:        1 << 20,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       1024,
+		TargetFileSize:      256,
+		BlockSize:           32,
+	}
+	model := make(map[string]string)
+	var copies []crashCopy
+	crashOpts := opts
+	crashOpts.FS = fs
+	testCrashPoints.Store(fs, func(step string) {
+		want := make(map[string]string, len(model))
+		for key, value := range model {
+			want[key] = value
+		}
+		copies = append(copies, crashCopy{step: step, fs: fs.CrashClone(), want: want})
+	})
+	defer testCrashPoints.Delete(fs)
+
+	tree, err := Open(dbDir, &crashOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 8; round++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key%03d", (round*25+i)%100)
+			if i%7 == 0 {
+				if err := tree.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				model[key] = ""
+				continue
+			}
+			value := fmt.Sprintf("value%d-%d", round, i)
+			if err := tree.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.WaitForCompactions(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open(dbDir, &crashOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := make(map[string]int)
+	for _, c := range copies {
+		steps[c.step]++
+	}
+	for _, step := range []string{
+		"open: MANIFEST written", "open: CURRENT switched",
+		"flush: disk table written", "flush: installed",
+		"compaction: output created", "compaction: output written",
+		"compaction: installing", "compaction: installed", "compaction: input deleted",
+	} {
+		if steps[step] == 0 {
+			t.Fatalf("no crash at %q, got %v", step, steps)
+		}
+	}
+
+	for _, c := range copies {
+		opts.FS = c.fs
+		tree, err := Open(dbDir, &opts)
+		if err != nil {
+			t.Fatalf("%s: %s", c.step, err)
+		}
+		for key, value := range c.want {
+			valueShouldBe(t, tree, key, value)
+		}
+
+		it, err := tree.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live := 0
+		for ; it.Valid(); it.Next() {
+			if c.want[string(it.Key())] != string(it.Value()) {
+				t.Fatalf("%s: %s should be %q, got %q", c.step, it.Key(), c.want[string(it.Key())], it.Value())
+			}
+			live++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wantLive := 0
+		for _, value := range c.want {
+			if value != "" {
+				wantLive++
+			}
+		}
+		if live != wantLive {
+			t.Fatalf("%s: %d keys should be live, got %d", c.step, wantLive, live)
+		}
+
+		// Compactions started by Open write disk tables that are not installed yet.
+		if err := tree.WaitForCompactions(); err != nil {
+			t.Fatal(err)
+		}
+		obsoleteFilesShouldBeRemoved(t, tree, c.step)
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// obsoleteFilesShouldBeRemoved checks that the directory of the tree only holds
+// the live disk tables, the live MANIFEST and no temporary CURRENT or options file.
+func obsoleteFilesShouldBeRemoved(t *testing.T, tree *LSMTree, step string) {
+	t.Helper()
+	tree.mu.RLock()
+	live := make(map[int]bool)
+	for _, tables := range tree.levels {
+		for _, table := range tables {
+			live[table.index] = true
+		}
+	}
+	manifest := manifestFileName(tree.manifest.number)
+	tree.mu.RUnlock()
+
+	names, err := tree.fs.List(tree.dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		switch {
+		case name == currentTempFileName || name == optionsTempFileName:
+			t.Fatalf("%s: %s should be removed", step, name)
+		case strings.HasPrefix(name, manifestFileNamePrefix) && name != manifest:
+			t.Fatalf("%s: %s should be removed, %s is live", step, name, manifest)
+		case strings.HasSuffix(name, diskTableFileNameSuffix):
+			index, err := strconv.Atoi(strings.TrimSuffix(name, diskTableFileNameSuffix))
+			if err != nil || !live[index] {
+				t.Fatalf("%s: %s should be removed", step, name)
+			}
+		}
+	}
+}
+
+// failingRemoveFS is a FS whose Remove fails while failing is set.
+type failingRemoveFS struct {
+	FS
+	failing int32
+}
+
+func (fs *failingRemoveFS) Remove(name string) error {
+	if atomic.LoadInt32(&fs.failing) != 0 {
+		return errors.New("remove failed")
+	}
+	return fs.FS.Remove(name)
+}
+
+func TestFailedRemovalKeepsWriting(t *testing.T) {
+	fs := &failingRemoveFS{FS: NewMemFS(), failing: 1}
+	opts := &Options{BlockSize: 32, FS: fs}
+	tree, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flushed WAL segments and the compacted disk tables cannot be removed.
+	for i := 0; i < 3; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key3"), []byte("value")); err != nil {
+		t.Fatalf("Put should succeed after failed removals, got %v", err)
+	}
+	names, err := fs.List("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskTables := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, diskTableFileNameSuffix) {
+			diskTables++
+		}
+	}
+	tree.mu.RLock()
+	live := len(tree.levels[0]) + len(tree.levels[1])
+	tree.mu.RUnlock()
+	if diskTables <= live {
+		t.Fatalf("compacted disk tables should be left behind, got %d files for %d live disk tables", diskTables, live)
+	}
+	if walNumbers, err := listWALs(fs, "db"); err != nil || len(walNumbers) < 2 {
+		t.Fatalf("flushed WAL segments should be left behind, got %v %v", walNumbers, err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next Open removes them.
+	atomic.StoreInt32(&fs.failing, 0)
+	tree, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < 4; i++ {
+		valueShouldBe(t, tree, fmt.Sprintf("key%d", i), "value")
+	}
+	obsoleteFilesShouldBeRemoved(t, tree, "reopen")
+	if walNumbers, err := listWALs(fs, "db"); err != nil || len(walNumbers) != 1 {
+		t.Fatalf("only the WAL segment of the memTable should be left, got %v %v", walNumbers, err)
+	}
+}
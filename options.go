@@ -0,0 +1,337 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// optionsFileName is the name of the file storing the options that affect on-disk layout.
+	optionsFileName = "options.dat"
+	// optionsTempFileName is the name the options file is written to before being renamed to optionsFileName.
+	optionsTempFileName = "options.dat.tmp"
+
+	// formatVersion is the version of the on-disk layout.
+	formatVersion = 10
+
+	// defaultMemTableSize is the default size of the memTable in bytes.
+	defaultMemTableSize = 4 << 20
+
+	// defaultMaxImmutableMemTables is the default number of memTables waiting for flush before writes stall.
+	defaultMaxImmutableMemTables = 2
+
+	// defaultL0CompactionTrigger is the default number of L0 disk tables that triggers a compaction.
+	defaultL0CompactionTrigger = 4
+
+	// defaultBaseLevelSize is the default size target of L1 in bytes.
+	defaultBaseLevelSize = 10 << 20
+
+	// defaultLevelSizeMultiplier is the default ratio between the size targets of two adjacent levels.
+	defaultLevelSizeMultiplier = 10
+
+	// defaultTargetFileSize is the default size of the disk tables written by compactions.
+	defaultTargetFileSize = 2 << 20
+
+	// defaultBlockSize is the default size of the data blocks of disk tables in bytes.
+	defaultBlockSize = 4 << 10
+
+	// defaultBloomBitsPerKey is the default number of bloom filter bits per key, about 1% false positives.
+	defaultBloomBitsPerKey = 10
+
+	// defaultSyncPeriod is the default interval between two syncs of the WAL with SyncPeriodic.
+	defaultSyncPeriod = 100 * time.Millisecond
+
+	// defaultLockTimeout is the default time a pessimistic transaction waits for a key lock.
+	defaultLockTimeout = time.Second
+)
+
+// ErrIncompatibleOptions is returned by Open when the options do not match the
+// options the database was created with.
+var ErrIncompatibleOptions = errors.New("lsmtree: incompatible options")
+
+// SyncMode tells when the WAL is synced to disk.
+type SyncMode int
+
+const (
+	// SyncAlways syncs the WAL after every write.
+	SyncAlways SyncMode = iota
+	// SyncNever leaves syncing the WAL to the operating system.
+	SyncNever
+	// SyncPeriodic syncs the WAL in the background every SyncPeriod.
+	// Writes of the last period may be lost on a crash.
+	SyncPeriodic
+)
+
+// WALRecoveryMode tells how Open handles corrupted records found while replaying the WAL.
+// Records dropped from the end of the WAL are truncated away.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryPointInTime replays the WAL up to the first corrupted record
+	// and drops everything from there on.
+	WALRecoveryPointInTime WALRecoveryMode = iota
+	// WALRecoveryTolerateCorruptedTail drops a corrupted last record, which is
+	// what a write torn by a crash leaves behind. Any other corruption fails Open.
+	WALRecoveryTolerateCorruptedTail
+	// WALRecoveryAbsoluteConsistency fails Open on any corrupted record, even a torn last record.
+	WALRecoveryAbsoluteConsistency
+	// WALRecoverySkipCorrupted skips every corrupted record and replays the others.
+	// A record whose length is corrupted is skipped up to the next valid record.
+	WALRecoverySkipCorrupted
+)
+
+// Logger is used to report background events such as flushes and compactions.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options are the tunables of a LSMTree.
+// Zero values are replaced with their defaults.
+type Options struct {
+	// MemTableSize is the approximate size in bytes of the memTable before it is flushed to disk.
+	MemTableSize int
+
+	// MaxImmutableMemTables is the number of full memTables waiting to be flushed
+	// in the background before writes stall.
+	MaxImmutableMemTables int
+
+	// CompactionPicker is the compaction strategy, LeveledCompactionPicker by default.
+	// The options below up to TargetFileSize only tune LeveledCompactionPicker.
+	CompactionPicker CompactionPicker
+
+	// L0CompactionTrigger is the number of L0 disk tables that triggers their compaction into L1.
+	L0CompactionTrigger int
+
+	// BaseLevelSize is the size target of L1 in bytes.
+	// A level over its target is compacted into the next level.
+	BaseLevelSize int
+
+	// LevelSizeMultiplier is the ratio between the size targets of a level and the level above it.
+	LevelSizeMultiplier int
+
+	// TargetFileSize is the approximate size in bytes of the disk tables written by compactions.
+	TargetFileSize int
+
+	// BlockSize is the approximate size in bytes of the data blocks of disk tables.
+	// A point lookup reads one data block.
+	BlockSize int
+
+	// BloomBitsPerKey is the number of bits per key of the bloom filter of each disk table.
+	// More bits use more memory and lower the false positive rate of Get on absent keys.
+	BloomBitsPerKey int
+
+	// Sync tells when the WAL is synced to disk.
+	// Concurrent writes are committed together, with one WAL write and at most one sync.
+	Sync SyncMode
+
+	// SyncPeriod is the interval between two syncs of the WAL with SyncPeriodic.
+	SyncPeriod time.Duration
+
+	// WALRecovery tells how corrupted WAL records are handled by Open, WALRecoveryPointInTime by default.
+	WALRecovery WALRecoveryMode
+
+	// LockTimeout is how long a pessimistic transaction waits for a key lock
+	// before failing with ErrLockTimeout.
+	LockTimeout time.Duration
+
+	// DisableChecksumVerification skips verifying the checksums of the data blocks
+	// read by Get and iterators. The WAL and compaction inputs are always verified.
+	DisableChecksumVerification bool
+
+	// Logger receives background events. Nothing is logged if nil.
+	Logger Logger
+
+	// FS is the file system holding the database, OSFS by default.
+	// NewMemFS returns an in-memory one.
+	FS FS
+}
+
+// withDefaults returns a copy of the options with zero values replaced by defaults.
+func (o *Options) withDefaults() *Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+
+	if opts.MemTableSize == 0 {
+		opts.MemTableSize = defaultMemTableSize
+	}
+	if opts.MaxImmutableMemTables == 0 {
+		opts.MaxImmutableMemTables = defaultMaxImmutableMemTables
+	}
+	if opts.CompactionPicker == nil {
+		opts.CompactionPicker = &LeveledCompactionPicker{}
+	}
+	if opts.L0CompactionTrigger == 0 {
+		opts.L0CompactionTrigger = defaultL0CompactionTrigger
+	}
+	if opts.BaseLevelSize == 0 {
+		opts.BaseLevelSize = defaultBaseLevelSize
+	}
+	if opts.LevelSizeMultiplier == 0 {
+		opts.LevelSizeMultiplier = defaultLevelSizeMultiplier
+	}
+	if opts.TargetFileSize == 0 {
+		opts.TargetFileSize = defaultTargetFileSize
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	if opts.BloomBitsPerKey == 0 {
+		opts.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	if opts.SyncPeriod == 0 {
+		opts.SyncPeriod = defaultSyncPeriod
+	}
+	if opts.LockTimeout == 0 {
+		opts.LockTimeout = defaultLockTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger{}
+	}
+	if opts.FS == nil {
+		opts.FS = OSFS
+	}
+	return &opts
+}
+
+// validate checks that all options are in range.
+func (o *Options) validate() error {
+	if o.MemTableSize < 0 {
+		return fmt.Errorf("lsmtree: MemTableSize must be positive, got %d", o.MemTableSize)
+	}
+	if o.MaxImmutableMemTables < 1 {
+		return fmt.Errorf("lsmtree: MaxImmutableMemTables must be positive, got %d", o.MaxImmutableMemTables)
+	}
+	if o.L0CompactionTrigger < 2 {
+		return fmt.Errorf("lsmtree: L0CompactionTrigger must be at least 2, got %d", o.L0CompactionTrigger)
+	}
+	if o.BaseLevelSize < 1 {
+		return fmt.Errorf("lsmtree: BaseLevelSize must be positive, got %d", o.BaseLevelSize)
+	}
+	if o.LevelSizeMultiplier < 2 {
+		return fmt.Errorf("lsmtree: LevelSizeMultiplier must be at least 2, got %d", o.LevelSizeMultiplier)
+	}
+	if o.TargetFileSize < 1 {
+		return fmt.Errorf("lsmtree: TargetFileSize must be positive, got %d", o.TargetFileSize)
+	}
+	if o.BlockSize < 1 {
+		return fmt.Errorf("lsmtree: BlockSize must be positive, got %d", o.BlockSize)
+	}
+	if o.BloomBitsPerKey < 1 {
+		return fmt.Errorf("lsmtree: BloomBitsPerKey must be positive, got %d", o.BloomBitsPerKey)
+	}
+	if o.Sync < SyncAlways || o.Sync > SyncPeriodic {
+		return fmt.Errorf("lsmtree: unknown SyncMode %d", o.Sync)
+	}
+	if o.SyncPeriod < 0 {
+		return fmt.Errorf("lsmtree: SyncPeriod must be positive, got %s", o.SyncPeriod)
+	}
+	if o.LockTimeout < 0 {
+		return fmt.Errorf("lsmtree: LockTimeout must be positive, got %s", o.LockTimeout)
+	}
+	if o.WALRecovery < WALRecoveryPointInTime || o.WALRecovery > WALRecoverySkipCorrupted {
+		return fmt.Errorf("lsmtree: unknown WALRecoveryMode %d", o.WALRecovery)
+	}
+	return o.CompactionPicker.validate()
+}
+
+// layoutOptions returns the persisted options, in the order they are written.
+func (o *Options) layoutOptions() []layoutOption {
+	return []layoutOption{
+		{name: "format_version", value: formatVersion},
+	}
+}
+
+// layoutOption is a named option persisted in the options file.
+type layoutOption struct {
+	name  string
+	value int
+}
+
+// checkOptionsFile compares the options with the options file in dbDir.
+// The options file is written if the database is new.
+func checkOptionsFile(fs FS, dbDir string, opts *Options) error {
+	stored, err := readOptionsFile(fs, dbDir)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return writeOptionsFile(fs, dbDir, opts.layoutOptions())
+	}
+
+	for _, option := range opts.layoutOptions() {
+		value, exists := stored[option.name]
+		if !exists {
+			return fmt.Errorf("%w: %s is missing from %s", ErrIncompatibleOptions, option.name, optionsFileName)
+		}
+		if value != option.value {
+			return fmt.Errorf("%w: %s is %d, database was created with %d", ErrIncompatibleOptions, option.name, option.value, value)
+		}
+	}
+	return nil
+}
+
+// readOptionsFile reads the options file in dbDir.
+// Returns nil if there is no options file.
+func readOptionsFile(fs FS, dbDir string) (map[string]int, error) {
+	optionsFilePath := path.Join(dbDir, optionsFileName)
+	f, err := fs.Open(optionsFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	defer f.Close()
+
+	options := make(map[string]int)
+	for {
+		name, value, _, err := decode(f)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF {
+			return options, nil
+		}
+		options[string(name)] = decodeInt(value)
+	}
+}
+
+// writeOptionsFile writes the options file in dbDir.
+// It is written to a temporary file renamed over the options file, so a crash never leaves a partial one.
+func writeOptionsFile(fs FS, dbDir string, options []layoutOption) error {
+	optionsTempFilePath := path.Join(dbDir, optionsTempFileName)
+	f, err := fs.Create(optionsTempFilePath)
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		if _, err := encode(f, []byte(option.name), encodeInt(option.value), recordTypePut); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(optionsTempFilePath, path.Join(dbDir, optionsFileName)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dbDir)
+}
+
+// discardLogger is a Logger that drops everything.
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
@@ -0,0 +1,97 @@
+package lsmtree
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestOptionsDefaults(t *testing.T) {
+	opts := (*Options)(nil).withDefaults()
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if opts.MemTableSize != defaultMemTableSize {
+		t.Errorf("MemTableSize should default to %d, got %d", defaultMemTableSize, opts.MemTableSize)
+	}
+	if opts.BlockSize != defaultBlockSize {
+		t.Errorf("BlockSize should default to %d, got %d", defaultBlockSize, opts.BlockSize)
+	}
+	if opts.Sync != SyncAlways {
+		t.Errorf("Sync should default to SyncAlways, got %d", opts.Sync)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	invalid := []*Options{
+		{MemTableSize: -1},
+		{MaxImmutableMemTables: -1},
+		{L0CompactionTrigger: 1},
+		{BlockSize: -2},
+		{BloomBitsPerKey: -1},
+		{Sync: SyncMode(42)},
+		{Sync: SyncPeriodic, SyncPeriod: -time.Second},
+		{LockTimeout: -time.Second},
+		{WALRecovery: WALRecoveryMode(-1)},
+		{CompactionPicker: &SizeTieredCompactionPicker{MinMergeWidth: 1}},
+		{CompactionPicker: &SizeTieredCompactionPicker{MinMergeWidth: 8, MaxMergeWidth: 4}},
+	}
+	for _, opts := range invalid {
+		if err := opts.withDefaults().validate(); err == nil {
+			t.Errorf("validate should reject %+v", *opts)
+		}
+	}
+}
+
+func TestOpenIncompatibleOptions(t *testing.T) {
+	fs, dbDir := NewMemFS(), "db"
+
+	tree, err := Open(dbDir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	// Options that do not affect the layout may change.
+	tree, err = Open(dbDir, &Options{BlockSize: 64, MemTableSize: 128, Sync: SyncNever, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	// A database written with another format version.
+	if err := writeOptionsFile(fs, dbDir, []layoutOption{{name: "format_version", value: formatVersion - 1}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(dbDir, &Options{BlockSize: 32, FS: fs})
+	if !errors.Is(err, ErrIncompatibleOptions) {
+		t.Fatalf("Open should fail with ErrIncompatibleOptions, got %v", err)
+	}
+	t.Log(err)
+}
+
+func TestOptionsFileCrash(t *testing.T) {
+	fs, dbDir := NewMemFS(), "db"
+	if err := fs.MkdirAll(dbDir); err != nil {
+		t.Fatal(err)
+	}
+	// A crash while writing the options file of a new database leaves a partial temporary file.
+	writeFile(t, fs, path.Join(dbDir, optionsTempFileName), []byte{0, 0, 0})
+
+	tree, err := Open(dbDir, &Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(path.Join(dbDir, optionsTempFileName)); !os.IsNotExist(err) {
+		t.Fatalf("temporary options file should be removed, got %v", err)
+	}
+	stored, err := readOptionsFile(fs, dbDir)
+	if err != nil || stored["format_version"] != formatVersion {
+		t.Fatalf("options file should hold format_version %d, got %v %v", formatVersion, stored, err)
+	}
+}
@@ -0,0 +1,107 @@
+package lsmtree
+
+import (
+	"bytes"
+)
+
+// CompactionPicker is a compaction strategy.
+// It decides which disk tables the compaction goroutine merges next.
+// LeveledCompactionPicker and SizeTieredCompactionPicker are the available strategies.
+type CompactionPicker interface {
+	// validate checks that the tunables of the strategy are in range.
+	validate() error
+	// pickCompaction returns the next compaction, nil if none is needed. t.mu must be held.
+	pickCompaction(t *LSMTree) *compaction
+	// compactRange compacts the disk tables holding keys in [start, end]. It runs in the compaction goroutine.
+	compactRange(t *LSMTree, start, end []byte) error
+}
+
+// LeveledCompactionPicker compacts a level into the next one whenever it is over its size target.
+// It is tuned by L0CompactionTrigger, BaseLevelSize, LevelSizeMultiplier and TargetFileSize,
+// and keeps read amplification low at the cost of rewriting data more often.
+type LeveledCompactionPicker struct{}
+
+func (p *LeveledCompactionPicker) validate() error {
+	return nil
+}
+
+// pickCompaction picks the compaction of the level most over its target.
+// All of L0 is compacted at once, since its disk tables may overlap. Above L0, disk tables are
+// picked in turn after the last compacted key of the level.
+func (p *LeveledCompactionPicker) pickCompaction(t *LSMTree) *compaction {
+	level, score := p.score(t)
+	if score < 1 {
+		return nil
+	}
+
+	c := &compaction{level: level, outputLevel: level + 1, maxOutputSize: t.opts.TargetFileSize}
+	if level == 0 {
+		c.inputs[0] = append([]*tableMeta(nil), t.levels[0]...)
+	} else {
+		tables := t.levels[level]
+		picked := tables[0]
+		for _, table := range tables {
+			if t.compactPointers[level] == nil || bytes.Compare(table.largest, t.compactPointers[level]) > 0 {
+				picked = table
+				break
+			}
+		}
+		c.inputs[0] = []*tableMeta{picked}
+	}
+
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = overlappingTables(t.levels[level+1], smallest, largest)
+	return c
+}
+
+// score returns the level most over its target and by how much.
+// L0 is scored by its number of disk tables, higher levels by their size.
+func (p *LeveledCompactionPicker) score(t *LSMTree) (int, float64) {
+	bestLevel := 0
+	bestScore := float64(len(t.levels[0])) / float64(t.opts.L0CompactionTrigger)
+	for level := 1; level < numLevels-1; level++ {
+		score := float64(totalSize(t.levels[level])) / maxBytesForLevel(t.opts, level)
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	return bestLevel, bestScore
+}
+
+// compactRange compacts the disk tables holding keys in [start, end] level by level,
+// down to the deepest level holding keys in that range.
+func (p *LeveledCompactionPicker) compactRange(t *LSMTree, start, end []byte) error {
+	t.mu.RLock()
+	maxLevel := 1
+	for level := 1; level < numLevels; level++ {
+		if len(overlappingTables(t.levels[level], start, end)) > 0 {
+			maxLevel = level
+		}
+	}
+	t.mu.RUnlock()
+
+	for level := 0; level < maxLevel; level++ {
+		t.mu.RLock()
+		c := &compaction{level: level, outputLevel: level + 1, maxOutputSize: t.opts.TargetFileSize}
+		if level == 0 {
+			if len(overlappingTables(t.levels[0], start, end)) > 0 {
+				c.inputs[0] = append([]*tableMeta(nil), t.levels[0]...)
+			}
+		} else {
+			c.inputs[0] = overlappingTables(t.levels[level], start, end)
+		}
+		if len(c.inputs[0]) > 0 {
+			smallest, largest := keyRange(c.inputs[0])
+			c.inputs[1] = overlappingTables(t.levels[level+1], smallest, largest)
+		}
+		t.mu.RUnlock()
+
+		if len(c.inputs[0]) == 0 {
+			continue
+		}
+		if err := t.runCompaction(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
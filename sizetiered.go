@@ -0,0 +1,105 @@
+package lsmtree
+
+import (
+	"fmt"
+)
+
+const (
+	// defaultMinMergeWidth is the default minimum number of disk tables merged by a size-tiered compaction.
+	defaultMinMergeWidth = 4
+
+	// defaultMaxMergeWidth is the default maximum number of disk tables merged by a size-tiered compaction.
+	defaultMaxMergeWidth = 32
+
+	// defaultSizeRatio is the default size ratio, in percent, of disk tables merged together.
+	defaultSizeRatio = 1
+)
+
+// SizeTieredCompactionPicker keeps every disk table in L0 as a sorted run, newest first,
+// and merges adjacent runs of similar size into one.
+// Data is rewritten about once per tier, which keeps write amplification low
+// at the cost of more disk tables to search on reads.
+// Disk tables already in higher levels are left as they are.
+// Zero values are replaced with their defaults.
+type SizeTieredCompactionPicker struct {
+	// MinMergeWidth is the minimum number of disk tables merged at once.
+	MinMergeWidth int
+
+	// MaxMergeWidth is the maximum number of disk tables merged at once.
+	MaxMergeWidth int
+
+	// SizeRatio is how much larger, in percent, a disk table may be than the
+	// total size of the newer disk tables it is merged with.
+	SizeRatio int
+}
+
+// tunables returns the tunables with zero values replaced by defaults.
+func (p *SizeTieredCompactionPicker) tunables() (int, int, int) {
+	minMergeWidth, maxMergeWidth, sizeRatio := p.MinMergeWidth, p.MaxMergeWidth, p.SizeRatio
+	if minMergeWidth == 0 {
+		minMergeWidth = defaultMinMergeWidth
+	}
+	if maxMergeWidth == 0 {
+		maxMergeWidth = defaultMaxMergeWidth
+	}
+	if sizeRatio == 0 {
+		sizeRatio = defaultSizeRatio
+	}
+	return minMergeWidth, maxMergeWidth, sizeRatio
+}
+
+func (p *SizeTieredCompactionPicker) validate() error {
+	minMergeWidth, maxMergeWidth, sizeRatio := p.tunables()
+	if minMergeWidth < 2 {
+		return fmt.Errorf("lsmtree: MinMergeWidth must be at least 2, got %d", minMergeWidth)
+	}
+	if maxMergeWidth < minMergeWidth {
+		return fmt.Errorf("lsmtree: MaxMergeWidth must be at least MinMergeWidth %d, got %d", minMergeWidth, maxMergeWidth)
+	}
+	if sizeRatio < 0 {
+		return fmt.Errorf("lsmtree: SizeRatio must be positive, got %d", sizeRatio)
+	}
+	return nil
+}
+
+// pickCompaction picks the newest window of at least MinMergeWidth adjacent disk tables
+// where every disk table is at most SizeRatio percent larger than the newer ones together.
+func (p *SizeTieredCompactionPicker) pickCompaction(t *LSMTree) *compaction {
+	minMergeWidth, maxMergeWidth, sizeRatio := p.tunables()
+
+	runs := t.levels[0]
+	for start := 0; start+minMergeWidth <= len(runs); start++ {
+		size := runs[start].size
+		end := start + 1
+		for end < len(runs) && end-start < maxMergeWidth && runs[end].size*100 <= size*(100+sizeRatio) {
+			size += runs[end].size
+			end++
+		}
+
+		if end-start >= minMergeWidth {
+			c := &compaction{level: 0, outputLevel: 0}
+			c.inputs[0] = append([]*tableMeta(nil), runs[start:end]...)
+			return c
+		}
+	}
+	return nil
+}
+
+// compactRange merges the disk tables from the newest one holding keys in [start, end]
+// to the oldest one into a single disk table.
+func (p *SizeTieredCompactionPicker) compactRange(t *LSMTree, start, end []byte) error {
+	t.mu.RLock()
+	c := &compaction{level: 0, outputLevel: 0}
+	for i, table := range t.levels[0] {
+		if table.overlaps(start, end) {
+			c.inputs[0] = append([]*tableMeta(nil), t.levels[0][i:]...)
+			break
+		}
+	}
+	t.mu.RUnlock()
+
+	if len(c.inputs[0]) < 2 {
+		return nil
+	}
+	return t.runCompaction(c)
+}
@@ -1,11 +1,18 @@
 package skiplist
 
+// Iterator iterates over a SkipList. Every method locks the list for reading,
+// so writers may keep inserting while the list is iterated.
+// An Iterator itself must not be shared between goroutines.
 type Iterator struct {
-	cur *node
+	list *SkipList
+	cur  *node
 }
 
 func (sk *SkipList) Iterator() *Iterator {
-	return &Iterator{cur: sk.head.next[0]}
+	sk.mu.RLock()
+	defer sk.mu.RUnlock()
+
+	return &Iterator{list: sk, cur: sk.head.next[0]}
 }
 
 func (it *Iterator) HasNext() bool {
@@ -13,8 +20,66 @@ func (it *Iterator) HasNext() bool {
 }
 
 func (it *Iterator) Next() ([]byte, []byte, error) {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
 	node := it.cur
 	it.cur = it.cur.next[0]
 
 	return node.key, node.value, nil
 }
+
+// Seek moves the iterator to the first key greater than or equal to key.
+func (it *Iterator) Seek(key []byte) {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.cur = it.list.getPrevNodes(key)[0].next[0]
+}
+
+// Valid returns true if the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.cur != nil
+}
+
+// Key returns the key the next call to Next would return.
+func (it *Iterator) Key() []byte {
+	return it.cur.key
+}
+
+// Value returns the value the next call to Next would return.
+func (it *Iterator) Value() []byte {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	return it.cur.value
+}
+
+// SeekForPrev moves the iterator to the last key less than or equal to key.
+func (it *Iterator) SeekForPrev(key []byte) {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	node := it.list.getPrevNodes(key)[0].next[0]
+	if node != nil && it.list.compare(node.key, key) == 0 {
+		it.cur = node
+		return
+	}
+	it.cur = it.list.findLessThan(key)
+}
+
+// SeekToLast moves the iterator to the last key.
+func (it *Iterator) SeekToLast() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.cur = it.list.findLast()
+}
+
+// Prev moves the iterator to the previous key.
+func (it *Iterator) Prev() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.cur = it.list.findLessThan(it.cur.key)
+}
@@ -3,10 +3,12 @@ package skiplist
 import (
 	"bytes"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 // SkipList is a skip list implementation.
+// It is safe for concurrent use, iterators included.
 
 const (
 	// MaxLevel is the maximum level of the skip list.
@@ -23,12 +25,21 @@ type node struct {
 }
 
 type SkipList struct {
+	mu     sync.RWMutex
 	head   *node
 	length int
 	level  int
+	// compare orders the keys, it returns -1, 0 or +1 like bytes.Compare.
+	compare func(a, b []byte) int
 }
 
 func NewSkipList() *SkipList {
+	return NewSkipListWithCompare(bytes.Compare)
+}
+
+// NewSkipListWithCompare returns a SkipList whose keys are ordered by compare,
+// which returns -1, 0 or +1 like bytes.Compare. Keys comparing equal are the same key.
+func NewSkipListWithCompare(compare func(a, b []byte) int) *SkipList {
 	// init random seed
 	rand.Seed(time.Now().UnixNano())
 
@@ -37,21 +48,25 @@ func NewSkipList() *SkipList {
 		key:  nil,
 	}
 	return &SkipList{
-		head:   head,
-		length: 0,
-		level:  1,
+		head:    head,
+		length:  0,
+		level:   1,
+		compare: compare,
 	}
 }
 
 func (sk *SkipList) Get(key []byte) ([]byte, bool) {
+	sk.mu.RLock()
+	defer sk.mu.RUnlock()
+
 	node := sk.head
 	for i := sk.level - 1; i >= 0; i-- {
-		for node.next[i] != nil && bytes.Compare(node.next[i].key, key) < 0 {
+		for node.next[i] != nil && sk.compare(node.next[i].key, key) < 0 {
 			node = node.next[i]
 		}
 	}
 	node = node.next[0]
-	if node == nil || !bytes.Equal(node.key, key) {
+	if node == nil || sk.compare(node.key, key) != 0 {
 		return nil, false
 	}
 	return node.value, true
@@ -61,7 +76,7 @@ func (sk *SkipList) getPrevNodes(key []byte) []*node {
 	prev := sk.head
 	prevNodes := make([]*node, MaxLevel)
 	for i := sk.level - 1; i >= 0; i-- {
-		for prev.next[i] != nil && bytes.Compare(prev.next[i].key, key) < 0 {
+		for prev.next[i] != nil && sk.compare(prev.next[i].key, key) < 0 {
 			prev = prev.next[i]
 		}
 		prevNodes[i] = prev
@@ -69,6 +84,30 @@ func (sk *SkipList) getPrevNodes(key []byte) []*node {
 	return prevNodes
 }
 
+// findLessThan returns the last node with key less than the given key.
+// Returns nil if there is no such node.
+func (sk *SkipList) findLessThan(key []byte) *node {
+	prev := sk.getPrevNodes(key)[0]
+	if prev == sk.head {
+		return nil
+	}
+	return prev
+}
+
+// findLast returns the last node, nil if the list is empty.
+func (sk *SkipList) findLast() *node {
+	node := sk.head
+	for i := sk.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == sk.head {
+		return nil
+	}
+	return node
+}
+
 func (sk *SkipList) randLevel() int {
 	level := 1
 	for level < MaxLevel && rand.Float64() < P {
@@ -78,8 +117,11 @@ func (sk *SkipList) randLevel() int {
 }
 
 func (sk *SkipList) Put(key []byte, value []byte) bool {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
 	prevNodes := sk.getPrevNodes(key)
-	if prevNodes[0].next[0] != nil && bytes.Equal(prevNodes[0].next[0].key, key) {
+	if prevNodes[0].next[0] != nil && sk.compare(prevNodes[0].next[0].key, key) == 0 {
 		prevNodes[0].next[0].value = value
 		return true
 	}
@@ -105,6 +147,9 @@ func (sk *SkipList) Put(key []byte, value []byte) bool {
 }
 
 func (sk *SkipList) Clear() {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
 	// init random seed
 	rand.Seed(time.Now().UnixNano())
 
@@ -2,7 +2,9 @@ package skiplist_test
 
 import (
 	"bytes"
+	"fmt"
 	"lsmtree/skiplist"
+	"sync"
 	"testing"
 )
 
@@ -143,3 +145,136 @@ func TestSkipListIteratorDelete(t *testing.T) {
 		prev = key
 	}
 }
+
+func TestSkipListIteratorSeek(t *testing.T) {
+	list := skiplist.NewSkipList()
+	for _, key := range []string{"1", "3", "5", "7"} {
+		list.Put([]byte(key), []byte(key))
+	}
+
+	it := list.Iterator()
+	it.Seek([]byte("4"))
+	if !it.Valid() || string(it.Key()) != "5" {
+		t.Fatalf("Seek failed: should be positioned at 5")
+	}
+	it.Next()
+	if !it.Valid() || string(it.Key()) != "7" {
+		t.Fatalf("Next failed: should be positioned at 7")
+	}
+
+	it.Seek([]byte("3"))
+	if !it.Valid() || string(it.Key()) != "3" {
+		t.Fatalf("Seek failed: should be positioned at 3")
+	}
+
+	it.Seek([]byte("8"))
+	if it.Valid() {
+		t.Fatalf("Seek failed: should be exhausted, got %s", it.Key())
+	}
+}
+
+func TestSkipListIteratorReverse(t *testing.T) {
+	list := skiplist.NewSkipList()
+	for _, key := range []string{"4", "2", "1", "3", "6", "5", "7"} {
+		list.Put([]byte(key), []byte(key))
+	}
+
+	it := list.Iterator()
+	it.SeekToLast()
+	prev := []byte("8")
+	count := 0
+	for it.Valid() {
+		if bytes.Compare(it.Key(), prev) >= 0 {
+			t.Errorf("Prev failed: prev key %s next key %s", prev, it.Key())
+		}
+		prev = it.Key()
+		count++
+		it.Prev()
+	}
+	if count != 7 {
+		t.Errorf("Prev failed: should visit 7 keys, visited %d", count)
+	}
+
+	it.SeekForPrev([]byte("45"))
+	if !it.Valid() || string(it.Key()) != "4" {
+		t.Fatalf("SeekForPrev failed: should be positioned at 4")
+	}
+	it.SeekForPrev([]byte("5"))
+	if !it.Valid() || string(it.Key()) != "5" {
+		t.Fatalf("SeekForPrev failed: should be positioned at 5")
+	}
+	it.SeekForPrev([]byte("0"))
+	if it.Valid() {
+		t.Fatalf("SeekForPrev failed: should be exhausted, got %s", it.Key())
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+	list := skiplist.NewSkipList()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("%d-%03d", w, i))
+				list.Put(key, key)
+				list.Get(key)
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				it := list.Iterator()
+				for it.HasNext() {
+					if _, _, err := it.Next(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%d-%03d", w, i))
+			getKeyShouldBe(t, list, key, key)
+		}
+	}
+}
+
+func TestSkipListCompare(t *testing.T) {
+	descending := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	list := skiplist.NewSkipListWithCompare(descending)
+	for _, key := range []string{"3", "1", "7", "5"} {
+		list.Put([]byte(key), []byte(key))
+	}
+	getKeyShouldBe(t, list, []byte("5"), []byte("5"))
+	getKeyShouldNotBe(t, list, []byte("4"))
+
+	it := list.Iterator()
+	var keys []string
+	for it.HasNext() {
+		key, _, _ := it.Next()
+		keys = append(keys, string(key))
+	}
+	if fmt.Sprint(keys) != "[7 5 3 1]" {
+		t.Fatalf("Iterator failed: keys should be in descending order, got %v", keys)
+	}
+
+	it.Seek([]byte("4"))
+	if !it.Valid() || string(it.Key()) != "3" {
+		t.Fatalf("Seek failed: should be positioned at 3")
+	}
+	it.SeekForPrev([]byte("4"))
+	if !it.Valid() || string(it.Key()) != "5" {
+		t.Fatalf("SeekForPrev failed: should be positioned at 5")
+	}
+}
@@ -0,0 +1,89 @@
+package lsmtree
+
+import "errors"
+
+// Snapshot is a consistent point-in-time view of the LSMTree.
+// Reads through a Snapshot see every write committed before it was taken and none after.
+// Compactions keep the versions a Snapshot sees until it is released with ReleaseSnapshot.
+type Snapshot struct {
+	t *LSMTree
+	// seq is the sequence number of the last write the snapshot sees.
+	seq uint64
+	// released is set by ReleaseSnapshot, protected by t.mu.
+	released bool
+}
+
+// ErrSnapshotReleased is returned by reads through a released Snapshot.
+var ErrSnapshotReleased = errors.New("lsmtree: snapshot released")
+
+// GetSnapshot returns a Snapshot of the current state of the tree.
+func (t *LSMTree) GetSnapshot() (*Snapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, ErrClosed
+	}
+
+	s := &Snapshot{t: t, seq: t.lastSequence}
+	t.snapshots = append(t.snapshots, s)
+	return s, nil
+}
+
+// ReleaseSnapshot releases the snapshot, later compactions may drop the versions only it sees.
+// Releasing a snapshot twice is a no-op.
+func (t *LSMTree) ReleaseSnapshot(s *Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	for i, snapshot := range t.snapshots {
+		if snapshot == s {
+			t.snapshots = append(t.snapshots[:i], t.snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshotSequences returns the sequence numbers of the open snapshots, ascending. mu must be held.
+func (t *LSMTree) snapshotSequences() []uint64 {
+	// Snapshots are taken in sequence order.
+	seqs := make([]uint64, len(t.snapshots))
+	for i, s := range t.snapshots {
+		seqs[i] = s.seq
+	}
+	return seqs
+}
+
+// Get returns the value for the given key as of the snapshot.
+// Deleted keys are reported as not found.
+func (s *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	return s.t.get(key, s)
+}
+
+// NewIterator returns an Iterator over the keys in [start, end) as of the snapshot,
+// positioned at the first key.
+func (s *Snapshot) NewIterator(start, end []byte) (*Iterator, error) {
+	return s.t.newIterator(start, end, false, s)
+}
+
+// NewReverseIterator returns an Iterator over the keys in [start, end) as of the snapshot,
+// in descending order, positioned at the last key.
+func (s *Snapshot) NewReverseIterator(start, end []byte) (*Iterator, error) {
+	return s.t.newIterator(start, end, true, s)
+}
+
+// readSequence returns the largest sequence number visible to a read through the snapshot,
+// the last sequence number for a nil snapshot. mu must be held.
+func (t *LSMTree) readSequence(s *Snapshot) (uint64, error) {
+	if s == nil {
+		return t.lastSequence, nil
+	}
+	if s.released {
+		return 0, ErrSnapshotReleased
+	}
+	return s.seq, nil
+}
@@ -0,0 +1,177 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// snapshotShouldSee checks the keys and values read through the snapshot with Get and both iterators.
+func snapshotShouldSee(t *testing.T, s *Snapshot, want map[string]string) {
+	t.Helper()
+	for _, key := range []string{"a", "b", "c"} {
+		value, exists, err := s.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantValue, ok := want[key]; exists != ok || string(value) != wantValue {
+			t.Fatalf("snapshot should read %s as %q (%v), got %q (%v)", key, wantValue, ok, value, exists)
+		}
+	}
+
+	for _, reverse := range []bool{false, true} {
+		var it *Iterator
+		var err error
+		if reverse {
+			it, err = s.NewReverseIterator(nil, nil)
+		} else {
+			it, err = s.NewIterator(nil, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for ; it.Valid(); it.Next() {
+			got[string(it.Key())] = string(it.Value())
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("snapshot iterator (reverse %v) should see %v, got %v", reverse, want, got)
+		}
+	}
+}
+
+// diskTableRecords returns the number of records in all disk tables.
+func diskTableRecords(t *testing.T, tree *LSMTree) int {
+	tree.mu.RLock()
+	levels := tree.levels
+	tree.mu.RUnlock()
+
+	count := 0
+	for _, tables := range levels {
+		for _, table := range tables {
+			count += countDiskTableEntries(t, tree.fs, tree.dbDir, table.index)
+		}
+	}
+	return count
+}
+
+func TestSnapshot(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Put([]byte(key), []byte(key+"1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tree.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Put([]byte("a"), []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("c"), []byte("c2")); err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]string{"a": "a1", "b": "b1"}
+	snapshotShouldSee(t, s, old)
+
+	// Compaction keeps the versions seen by the snapshot.
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshotShouldSee(t, s, old)
+	if value, _, err := tree.Get([]byte("a")); err != nil || string(value) != "a2" {
+		t.Fatalf("a should be a2, got %s %v", value, err)
+	}
+	if _, exists, err := tree.Get([]byte("b")); err != nil || exists {
+		t.Fatalf("b should be deleted, got %v %v", exists, err)
+	}
+	if count := diskTableRecords(t, tree); count != 5 {
+		t.Fatalf("disk tables should hold 5 records while the snapshot is open, got %d", count)
+	}
+
+	// Once released, the old versions and the tombstone are dropped.
+	tree.ReleaseSnapshot(s)
+	tree.ReleaseSnapshot(s)
+	if _, _, err := s.Get([]byte("a")); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("Get should fail with ErrSnapshotReleased, got %v", err)
+	}
+	if _, err := s.NewIterator(nil, nil); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("NewIterator should fail with ErrSnapshotReleased, got %v", err)
+	}
+	// A new L0 disk table makes the next compaction rewrite L1.
+	if err := tree.Put([]byte("c"), []byte("c3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if count := diskTableRecords(t, tree); count != 2 {
+		t.Fatalf("disk tables should hold 2 records after the release, got %d", count)
+	}
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{MemTableSize: 256, L0CompactionTrigger: 2, BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keyNum = 50
+	var snapshots []*Snapshot
+	for round := 0; round < 5; round++ {
+		for i := 0; i < keyNum; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := tree.GetSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	if err := tree.WaitForCompactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every snapshot reads all keys as of its round, through flushes and compactions.
+	for round, s := range snapshots {
+		it, err := s.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for ; it.Valid(); it.Next() {
+			if string(it.Value()) != fmt.Sprintf("value%d", round) {
+				t.Fatalf("snapshot %d should read %s as value%d, got %s", round, it.Key(), round, it.Value())
+			}
+			n++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != keyNum {
+			t.Fatalf("snapshot %d should read %d keys, got %d", round, keyNum, n)
+		}
+		tree.ReleaseSnapshot(s)
+	}
+}
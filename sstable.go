@@ -0,0 +1,477 @@
+package lsmtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// sstable format:
+// [data block]...[data block][index block][filter block][properties block][footer]
+//
+// Every block but the footer is followed by the checksum of its content.
+//
+// data block: records as written by encode, sorted by internal key.
+// A data block is closed once it reaches the block size.
+// index block: for every data block, a record of its last internal key and its block handle.
+// filter block: the bloom filter of all user keys.
+// properties block: records of a property name and its value.
+// footer: [index handle][filter handle][properties handle][format version][magic]
+// block handle: [offset][size], size does not count the checksum.
+
+const (
+	// sstMagic ends every sstable, "lsmtree" followed by 0x01.
+	sstMagic = 0x6c736d7472656501
+
+	// sstFormatVersion is the version of the sstable format.
+	sstFormatVersion = 3
+
+	// blockHandleSize is the size of an encoded block handle.
+	blockHandleSize = 16
+
+	// sstFooterSize is the size of the footer.
+	sstFooterSize = 3*blockHandleSize + 16
+)
+
+// sstable properties.
+const (
+	propertyNumEntries   = "num_entries"
+	propertyNumDeletions = "num_deletions"
+	propertyDataSize     = "data_size"
+	propertyIndexSize    = "index_size"
+	propertyFilterSize   = "filter_size"
+)
+
+// blockHandle is the location of a block in the sstable.
+type blockHandle struct {
+	offset, size int
+}
+
+// encodeBlockHandle encodes the block handle.
+func encodeBlockHandle(h blockHandle) []byte {
+	return append(encodeInt(h.offset), encodeInt(h.size)...)
+}
+
+// decodeBlockHandle decodes the block handle from slice of bytes.
+func decodeBlockHandle(encoded []byte) blockHandle {
+	return blockHandle{offset: decodeInt(encoded[:8]), size: decodeInt(encoded[8:16])}
+}
+
+// sstWriter writes key-values sorted by key to a new sstable.
+type sstWriter struct {
+	file File
+	w    *bufio.Writer
+
+	blockSize       int
+	bloomBitsPerKey int
+
+	// block is the data block being filled, blockLastKey its last internal key.
+	block        bytes.Buffer
+	blockLastKey []byte
+	// offset is the number of bytes written to the file.
+	offset int
+
+	index         bytes.Buffer
+	filterBuilder bloomFilterBuilder
+	filter        []byte
+
+	numEntries, numDeletions, dataSize int
+
+	// smallest and largest are the first and last user keys written.
+	smallest, largest []byte
+	// smallestSeq and largestSeq are the smallest and largest sequence numbers written.
+	smallestSeq, largestSeq uint64
+
+	finished bool
+}
+
+// newSSTWriter creates the sstable at path.
+func newSSTWriter(fs FS, path string, blockSize, bloomBitsPerKey int) (*sstWriter, error) {
+	file, err := fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sstWriter{
+		file:            file,
+		w:               bufio.NewWriter(file),
+		blockSize:       blockSize,
+		bloomBitsPerKey: bloomBitsPerKey,
+	}, nil
+}
+
+// write the record of the internal key with its value and record type.
+// Internal keys must be written in ascending order.
+func (sw *sstWriter) write(key, value []byte, rt recordType) error {
+	if _, err := encode(&sw.block, key, value, rt); err != nil {
+		return err
+	}
+	sw.blockLastKey = key
+
+	// Versions of the same user key are written next to each other, the filter needs it once.
+	ukey := extractUserKey(key)
+	if sw.numEntries == 0 || !bytes.Equal(ukey, sw.largest) {
+		sw.filterBuilder.add(ukey)
+	}
+	seq := internalKeySequence(key)
+	if sw.numEntries == 0 {
+		sw.smallest = ukey
+		sw.smallestSeq, sw.largestSeq = seq, seq
+	}
+	sw.largest = ukey
+	if seq < sw.smallestSeq {
+		sw.smallestSeq = seq
+	}
+	if seq > sw.largestSeq {
+		sw.largestSeq = seq
+	}
+	sw.numEntries++
+	if rt == recordTypeDelete {
+		sw.numDeletions++
+	}
+
+	if sw.block.Len() >= sw.blockSize {
+		return sw.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes the data block being filled and adds it to the index block.
+func (sw *sstWriter) flushBlock() error {
+	if sw.block.Len() == 0 {
+		return nil
+	}
+
+	handle, err := sw.writeBlock(sw.block.Bytes())
+	if err != nil {
+		return err
+	}
+	sw.dataSize += handle.size
+	sw.block.Reset()
+
+	_, err = encode(&sw.index, sw.blockLastKey, encodeBlockHandle(handle), recordTypePut)
+	return err
+}
+
+// writeBlock writes a block followed by its checksum at the end of the file.
+func (sw *sstWriter) writeBlock(block []byte) (blockHandle, error) {
+	handle := blockHandle{offset: sw.offset, size: len(block)}
+	if _, err := sw.w.Write(block); err != nil {
+		return blockHandle{}, err
+	}
+
+	trailer := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(trailer, checksum(block))
+	if _, err := sw.w.Write(trailer); err != nil {
+		return blockHandle{}, err
+	}
+	sw.offset += len(block) + checksumSize
+	return handle, nil
+}
+
+// finish writes the last data block, the index, filter and properties blocks and the footer, only once.
+func (sw *sstWriter) finish() error {
+	if sw.finished {
+		return nil
+	}
+
+	if err := sw.flushBlock(); err != nil {
+		return err
+	}
+
+	indexHandle, err := sw.writeBlock(sw.index.Bytes())
+	if err != nil {
+		return err
+	}
+
+	filter := sw.filterBuilder.build(sw.bloomBitsPerKey)
+	filterHandle, err := sw.writeBlock(filter)
+	if err != nil {
+		return err
+	}
+
+	var properties bytes.Buffer
+	for _, property := range []struct {
+		name  string
+		value int
+	}{
+		{propertyNumEntries, sw.numEntries},
+		{propertyNumDeletions, sw.numDeletions},
+		{propertyDataSize, sw.dataSize},
+		{propertyIndexSize, indexHandle.size},
+		{propertyFilterSize, filterHandle.size},
+	} {
+		if _, err := encode(&properties, []byte(property.name), encodeInt(property.value), recordTypePut); err != nil {
+			return err
+		}
+	}
+	propertiesHandle, err := sw.writeBlock(properties.Bytes())
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, sstFooterSize)
+	footer = append(footer, encodeBlockHandle(indexHandle)...)
+	footer = append(footer, encodeBlockHandle(filterHandle)...)
+	footer = append(footer, encodeBlockHandle(propertiesHandle)...)
+	footer = append(footer, encodeInt(sstFormatVersion)...)
+	footer = append(footer, encodeInt(sstMagic)...)
+	if _, err := sw.w.Write(footer); err != nil {
+		return err
+	}
+	sw.offset += len(footer)
+
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	sw.filter = filter
+	sw.finished = true
+	return nil
+}
+
+// size returns the number of bytes of the sstable written so far.
+func (sw *sstWriter) size() int {
+	return sw.offset + sw.block.Len()
+}
+
+// meta returns the description of the sstable.
+// It is complete once the sstWriter is synced or closed.
+func (sw *sstWriter) meta(index int) *tableMeta {
+	return &tableMeta{
+		index:       index,
+		size:        sw.size(),
+		smallest:    sw.smallest,
+		largest:     sw.largest,
+		smallestSeq: sw.smallestSeq,
+		largestSeq:  sw.largestSeq,
+		filter:      sw.filter,
+	}
+}
+
+// sync finishes the sstable and syncs it to disk.
+func (sw *sstWriter) sync() error {
+	if err := sw.finish(); err != nil {
+		return err
+	}
+	return sw.file.Sync()
+}
+
+// close finishes the sstable if needed and closes the file.
+func (sw *sstWriter) close() error {
+	err := sw.finish()
+	if closeErr := sw.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sstReader reads an sstable. The index block is kept in memory.
+type sstReader struct {
+	file File
+	// verify tells whether the checksums of data blocks are verified.
+	// The other blocks are always verified.
+	verify bool
+
+	index                          []indexEntry
+	filterHandle, propertiesHandle blockHandle
+}
+
+// indexEntry is a decoded entry of the index block.
+type indexEntry struct {
+	lastKey []byte
+	handle  blockHandle
+}
+
+// blockEntry is a decoded record of a data block.
+type blockEntry struct {
+	key, value []byte
+	rt         recordType
+}
+
+// openSSTReader opens the sstable at path and reads its footer and index block.
+// Data blocks are verified against their checksum if verify is true.
+func openSSTReader(fs FS, path string, verify bool) (*sstReader, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &sstReader{file: file, verify: verify}
+	if err := sr.readFooter(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sr, nil
+}
+
+// readFooter checks the footer and loads the index block.
+func (sr *sstReader) readFooter() error {
+	info, err := sr.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < sstFooterSize {
+		return sr.corruption(0, "file too short")
+	}
+
+	footerOffset := int(info.Size()) - sstFooterSize
+	footer, err := sr.readAt(footerOffset, sstFooterSize)
+	if err != nil {
+		return err
+	}
+	if decodeInt(footer[3*blockHandleSize+8:]) != sstMagic {
+		return sr.corruption(footerOffset, "bad magic number")
+	}
+	if decodeInt(footer[3*blockHandleSize:]) != sstFormatVersion {
+		return sr.corruption(footerOffset, "unknown format version")
+	}
+
+	indexHandle := decodeBlockHandle(footer[0:])
+	sr.filterHandle = decodeBlockHandle(footer[blockHandleSize:])
+	sr.propertiesHandle = decodeBlockHandle(footer[2*blockHandleSize:])
+	for _, h := range []blockHandle{indexHandle, sr.filterHandle, sr.propertiesHandle} {
+		if h.offset < 0 || h.size < 0 || h.offset+h.size+checksumSize > footerOffset {
+			return sr.corruption(footerOffset, "block handle out of range")
+		}
+	}
+
+	index, err := sr.readBlock(indexHandle, true)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(index)
+	for r.Len() > 0 {
+		lastKey, handle, _, err := decode(r)
+		if err != nil {
+			return sr.corruption(indexHandle.offset, err.Error())
+		}
+		if len(handle) != blockHandleSize || !validInternalKey(lastKey) {
+			return sr.corruption(indexHandle.offset, "bad index entry")
+		}
+		sr.index = append(sr.index, indexEntry{lastKey: lastKey, handle: decodeBlockHandle(handle)})
+	}
+	return nil
+}
+
+// readAt reads size bytes at offset.
+func (sr *sstReader) readAt(offset, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := sr.file.ReadAt(b, int64(offset)); err != nil {
+		if err == io.EOF {
+			return nil, sr.corruption(offset, "unexpected end of file")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// readBlock reads the block at the handle, verifies its checksum if verify is true.
+func (sr *sstReader) readBlock(h blockHandle, verify bool) ([]byte, error) {
+	b, err := sr.readAt(h.offset, h.size+checksumSize)
+	if err != nil {
+		return nil, err
+	}
+
+	block := b[:h.size]
+	if verify && binary.BigEndian.Uint32(b[h.size:]) != checksum(block) {
+		return nil, sr.corruption(h.offset, "block checksum mismatch")
+	}
+	return block, nil
+}
+
+// readDataBlock reads and decodes the i-th data block.
+func (sr *sstReader) readDataBlock(i int) ([]blockEntry, error) {
+	h := sr.index[i].handle
+	block, err := sr.readBlock(h, sr.verify)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []blockEntry
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		key, value, rt, err := decode(r)
+		if err != nil {
+			return nil, sr.corruption(h.offset, err.Error())
+		}
+		if !validInternalKey(key) || internalKeyType(key) != rt {
+			return nil, sr.corruption(h.offset, "bad internal key")
+		}
+		entries = append(entries, blockEntry{key: key, value: value, rt: rt})
+	}
+	if len(entries) == 0 {
+		return nil, sr.corruption(h.offset, "empty data block")
+	}
+	return entries, nil
+}
+
+// findBlock returns the first data block whose last internal key is greater than or equal to key,
+// len(sr.index) if there is none.
+func (sr *sstReader) findBlock(key []byte) int {
+	return sort.Search(len(sr.index), func(i int) bool {
+		return compareInternalKeys(sr.index[i].lastKey, key) >= 0
+	})
+}
+
+// get searches the newest version of key visible at the sequence number.
+// Returns the value and the internal key, tombstones are reported as found.
+func (sr *sstReader) get(key []byte, seq uint64) ([]byte, []byte, bool, error) {
+	ikey := seekKey(key, seq)
+	i := sr.findBlock(ikey)
+	if i == len(sr.index) {
+		return nil, nil, false, nil
+	}
+
+	entries, err := sr.readDataBlock(i)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// The last internal key of the block is greater than or equal to ikey, the entry exists.
+	j := sort.Search(len(entries), func(j int) bool {
+		return compareInternalKeys(entries[j].key, ikey) >= 0
+	})
+	if !bytes.Equal(extractUserKey(entries[j].key), key) {
+		return nil, nil, false, nil
+	}
+	return entries[j].value, entries[j].key, true, nil
+}
+
+// readFilter reads the filter block.
+func (sr *sstReader) readFilter() ([]byte, error) {
+	return sr.readBlock(sr.filterHandle, true)
+}
+
+// readProperties reads the properties block.
+func (sr *sstReader) readProperties() (map[string]int, error) {
+	h := sr.propertiesHandle
+	block, err := sr.readBlock(h, true)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]int)
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		name, value, _, err := decode(r)
+		if err != nil {
+			return nil, sr.corruption(h.offset, err.Error())
+		}
+		if len(value) != 8 {
+			return nil, sr.corruption(h.offset, "bad property value")
+		}
+		properties[string(name)] = decodeInt(value)
+	}
+	return properties, nil
+}
+
+// corruption returns a *CorruptionError for the data at offset in the sstable.
+func (sr *sstReader) corruption(offset int, reason string) error {
+	return &CorruptionError{Path: sr.file.Name(), Offset: int64(offset), Reason: reason}
+}
+
+// close closes the sstable.
+func (sr *sstReader) close() error {
+	return sr.file.Close()
+}
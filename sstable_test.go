@@ -0,0 +1,175 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// writeSSTable writes keyNum keys to a new sstable with small data blocks, every tenth key is a tombstone.
+// The i-th key is written with sequence number i+1.
+func writeSSTable(t *testing.T, fs FS, dir string, keyNum int) *tableMeta {
+	w, err := newSSTWriter(fs, diskTablePath(dir, 0), 64, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keyNum; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i%10 == 0 {
+			err = w.write(makeInternalKey(key, uint64(i+1), recordTypeDelete), nil, recordTypeDelete)
+		} else {
+			err = w.write(makeInternalKey(key, uint64(i+1), recordTypePut), []byte(fmt.Sprintf("value%d", i)), recordTypePut)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.meta(0)
+}
+
+func TestSSTable(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+	const keyNum = 500
+	meta := writeSSTable(t, fs, dir, keyNum)
+
+	if size := len(readFile(t, fs, diskTablePath(dir, 0))); size != meta.size {
+		t.Fatalf("sstable size should be %d, got %d", meta.size, size)
+	}
+
+	sr, err := openSSTReader(fs, diskTablePath(dir, 0), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.close()
+
+	if len(sr.index) < 10 {
+		t.Fatalf("sstable should have many data blocks, got %d", len(sr.index))
+	}
+
+	for i := 0; i < keyNum; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		value, ikey, exists, err := sr.get(key, maxSequenceNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("get failed: key %s should exist", key)
+		}
+		if i%10 == 0 {
+			if internalKeyType(ikey) != recordTypeDelete {
+				t.Fatalf("get failed: key %s should be a tombstone", key)
+			}
+			continue
+		}
+		if internalKeyType(ikey) != recordTypePut || internalKeySequence(ikey) != uint64(i+1) || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("get failed: key %s should be value%d, got %s", key, i, value)
+		}
+	}
+	for _, key := range []string{"a", "key0001.", "zzz"} {
+		if _, _, exists, err := sr.get([]byte(key), maxSequenceNumber); err != nil || exists {
+			t.Fatalf("get failed: key %s should not exist, got %v %v", key, exists, err)
+		}
+	}
+	// key0005 is written with sequence number 6.
+	if _, _, exists, err := sr.get([]byte("key0005"), 5); err != nil || exists {
+		t.Fatalf("get failed: key0005 should not be visible at sequence 5, got %v %v", exists, err)
+	}
+
+	filter, err := sr.readFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bloomFilterMayContain(filter, []byte("key0042")) {
+		t.Fatal("filter should contain key0042")
+	}
+
+	properties, err := sr.readProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties[propertyNumEntries] != keyNum || properties[propertyNumDeletions] != keyNum/10 {
+		t.Fatalf("properties should count %d entries and %d deletions, got %v", keyNum, keyNum/10, properties)
+	}
+}
+
+func TestSSTableCorruptFooter(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+	writeSSTable(t, fs, dir, 100)
+
+	data := readFile(t, fs, diskTablePath(dir, 0))
+
+	for _, pos := range []int{len(data) - 1, len(data) - 9} {
+		corrupted := append([]byte(nil), data...)
+		corrupted[pos] ^= 0xff
+		writeFile(t, fs, diskTablePath(dir, 1), corrupted)
+		if _, err := openSSTReader(fs, diskTablePath(dir, 1), true); !errors.Is(err, ErrCorruption) {
+			t.Fatalf("openSSTReader should fail with ErrCorruption on a bad footer, got %v", err)
+		}
+	}
+
+	writeFile(t, fs, diskTablePath(dir, 2), data[:sstFooterSize-1])
+	if _, err := openSSTReader(fs, diskTablePath(dir, 2), true); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("openSSTReader should fail with ErrCorruption on a truncated table, got %v", err)
+	}
+}
+
+func TestSSTableChecksum(t *testing.T) {
+	fs, dir := NewMemFS(), "."
+	writeSSTable(t, fs, dir, 100)
+
+	sr, err := openSSTReader(fs, diskTablePath(dir, 0), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := sr.index[1].handle
+	lastKey := extractUserKey(sr.index[1].lastKey)
+	sr.close()
+
+	// Flip a bit of the last value of the second data block.
+	data := readFile(t, fs, diskTablePath(dir, 0))
+	data[handle.offset+handle.size-1] ^= 0x01
+	writeFile(t, fs, diskTablePath(dir, 0), data)
+
+	sr, err = openSSTReader(fs, diskTablePath(dir, 0), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = sr.get(lastKey, maxSequenceNumber)
+	sr.close()
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || !errors.Is(err, ErrCorruption) {
+		t.Fatalf("get should fail with ErrCorruption, got %v", err)
+	}
+	if corruption.Path != diskTablePath(dir, 0) || corruption.Offset != int64(handle.offset) {
+		t.Fatalf("corruption should be reported in %s at offset %d, got %s at offset %d",
+			diskTablePath(dir, 0), handle.offset, corruption.Path, corruption.Offset)
+	}
+
+	// Other blocks are still readable.
+	sr, err = openSSTReader(fs, diskTablePath(dir, 0), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, exists, err := sr.get([]byte("key0001"), maxSequenceNumber)
+	sr.close()
+	if err != nil || !exists {
+		t.Fatalf("key0001 should exist, got %v %v", exists, err)
+	}
+
+	// Without verification the corrupted value is returned.
+	sr, err = openSSTReader(fs, diskTablePath(dir, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, exists, err = sr.get(lastKey, maxSequenceNumber)
+	sr.close()
+	if err != nil || !exists {
+		t.Fatalf("%s should exist without verification, got %v %v", lastKey, exists, err)
+	}
+}
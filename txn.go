@@ -0,0 +1,245 @@
+package lsmtree
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrConflict is returned by Txn.Commit when a key read by the transaction
+// was written by someone else after the transaction began.
+var ErrConflict = errors.New("lsmtree: transaction conflict")
+
+// ErrTxnDone is returned by every call on a committed or rolled back Txn.
+var ErrTxnDone = errors.New("lsmtree: transaction already committed or rolled back")
+
+// Txn is a transaction.
+// Get sees the tree as of the start of the transaction and the writes of the transaction itself.
+// Writes are buffered until Commit, which applies them atomically as one WAL record.
+//
+// An optimistic transaction, started by BeginTxn, takes no locks: Commit fails
+// if a key read by the transaction was written since it started.
+// A pessimistic transaction, started by BeginPessimisticTxn, locks every key it
+// writes or reads with GetForUpdate until it ends, so Commit does not conflict
+// with other pessimistic transactions. The locks only exclude pessimistic transactions:
+// LSMTree.Put, Delete and Write and the commits of optimistic transactions do not take them.
+//
+// A Txn must not be used from several goroutines at once.
+type Txn struct {
+	t *LSMTree
+	// snapshot is the state of the tree the transaction reads, held until the end of the transaction
+	// so compactions keep the tombstones the conflict check needs.
+	snapshot *Snapshot
+
+	// pessimistic transactions lock keys instead of checking conflicts on commit.
+	pessimistic bool
+	// id identifies the transaction in the lock manager, locked are the keys it locked.
+	id     uint64
+	locked map[string]struct{}
+
+	// writes are the buffered writes by key, the last write of a key wins.
+	writes map[string]txnWrite
+	// reads are the keys read by the transaction.
+	reads map[string]struct{}
+	done  bool
+}
+
+// txnWrite is a buffered write of a Txn.
+type txnWrite struct {
+	value []byte
+	rt    recordType
+}
+
+// BeginTxn starts an optimistic transaction.
+// It must be ended by Commit or Rollback.
+func (t *LSMTree) BeginTxn() (*Txn, error) {
+	return t.beginTxn(false)
+}
+
+// BeginPessimisticTxn starts a pessimistic transaction.
+// It must be ended by Commit or Rollback, which release its locks.
+func (t *LSMTree) BeginPessimisticTxn() (*Txn, error) {
+	return t.beginTxn(true)
+}
+
+// beginTxn starts a transaction.
+func (t *LSMTree) beginTxn(pessimistic bool) (*Txn, error) {
+	snapshot, err := t.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	txn := &Txn{
+		t:           t,
+		snapshot:    snapshot,
+		pessimistic: pessimistic,
+		writes:      make(map[string]txnWrite),
+		reads:       make(map[string]struct{}),
+	}
+	if pessimistic {
+		txn.id = t.locks.newID()
+		txn.locked = make(map[string]struct{})
+	}
+	return txn, nil
+}
+
+// Get returns the value for the given key, as written by the transaction or as of BeginTxn.
+// Deleted keys are reported as not found.
+func (txn *Txn) Get(key []byte) ([]byte, bool, error) {
+	if txn.done {
+		return nil, false, ErrTxnDone
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		return w.value, w.rt == recordTypePut, nil
+	}
+
+	if !txn.pessimistic {
+		txn.reads[string(key)] = struct{}{}
+	}
+	return txn.snapshot.Get(key)
+}
+
+// GetForUpdate returns the value for the given key like Get, for a key the transaction is about to write.
+// A pessimistic transaction first locks the key, waiting at most Options.LockTimeout for
+// another transaction holding it, and reads the latest value. It fails with ErrLockTimeout
+// or ErrDeadlock if the lock cannot be taken, the transaction should then be rolled back.
+// The value may still be changed by a write outside of pessimistic transactions.
+func (txn *Txn) GetForUpdate(key []byte) ([]byte, bool, error) {
+	if !txn.pessimistic {
+		return txn.Get(key)
+	}
+	if txn.done {
+		return nil, false, ErrTxnDone
+	}
+	if err := txn.lock(key); err != nil {
+		return nil, false, err
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		return w.value, w.rt == recordTypePut, nil
+	}
+	// No other pessimistic transaction writes the key while it is locked.
+	return txn.t.Get(key)
+}
+
+// lock takes the lock of key for a pessimistic transaction.
+func (txn *Txn) lock(key []byte) error {
+	if _, ok := txn.locked[string(key)]; ok {
+		return nil
+	}
+	if err := txn.t.locks.lock(txn.id, string(key), txn.t.opts.LockTimeout); err != nil {
+		return err
+	}
+	txn.locked[string(key)] = struct{}{}
+	return nil
+}
+
+// Put buffers setting the value for the given key.
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.set(key, value, recordTypePut)
+}
+
+// Delete buffers removing the given key.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.set(key, nil, recordTypeDelete)
+}
+
+// set buffers a write of the given type. A pessimistic transaction locks the key first.
+func (txn *Txn) set(key, value []byte, rt recordType) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if txn.pessimistic {
+		if err := txn.lock(key); err != nil {
+			return err
+		}
+	}
+	// The caller may reuse key and value.
+	if rt == recordTypePut {
+		value = append([]byte{}, value...)
+	}
+	txn.writes[string(key)] = txnWrite{value: value, rt: rt}
+	return nil
+}
+
+// Commit applies the writes of the transaction atomically.
+// An optimistic transaction fails with ErrConflict, leaving the tree unchanged, if a key
+// it read was written since BeginTxn. The transaction is ended either way.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.end()
+
+	if txn.pessimistic {
+		if len(txn.writes) == 0 {
+			return nil
+		}
+		return txn.t.write(txn.batch().Data(), nil)
+	}
+
+	if len(txn.writes) == 0 {
+		txn.t.mu.RLock()
+		defer txn.t.mu.RUnlock()
+		if txn.t.closed {
+			return ErrClosed
+		}
+		return txn.checkConflicts()
+	}
+
+	return txn.t.write(txn.batch().Data(), func() error {
+		txn.t.mu.RLock()
+		defer txn.t.mu.RUnlock()
+		return txn.checkConflicts()
+	})
+}
+
+// Rollback discards the writes of the transaction and ends it.
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.end()
+	return nil
+}
+
+// end releases the snapshot and the locks of the transaction.
+func (txn *Txn) end() {
+	txn.done = true
+	txn.t.ReleaseSnapshot(txn.snapshot)
+	if txn.pessimistic {
+		keys := make([]string, 0, len(txn.locked))
+		for key := range txn.locked {
+			keys = append(keys, key)
+		}
+		txn.t.locks.unlock(txn.id, keys)
+	}
+}
+
+// batch returns the buffered writes as a write batch, in key order.
+func (txn *Txn) batch() *WriteBatch {
+	keys := make([]string, 0, len(txn.writes))
+	for key := range txn.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var batch WriteBatch
+	for _, key := range keys {
+		w := txn.writes[key]
+		batch.add([]byte(key), w.value, w.rt)
+	}
+	return &batch
+}
+
+// checkConflicts returns ErrConflict if a key read by the transaction has a record
+// newer than its snapshot. mu must be held.
+func (txn *Txn) checkConflicts() error {
+	for key := range txn.reads {
+		_, ikey, exists, err := txn.t.lookup([]byte(key), maxSequenceNumber)
+		if err != nil {
+			return err
+		}
+		if exists && internalKeySequence(ikey) > txn.snapshot.seq {
+			return ErrConflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package lsmtree
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestTree opens a tree in a new MemFS, unless opts selects another FS.
+func openTestTree(t *testing.T, opts *Options) *LSMTree {
+	if opts.FS == nil {
+		opts.FS = NewMemFS()
+	}
+	tree, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// valueShouldBe checks the value of key in the tree, "" for a missing key.
+func valueShouldBe(t *testing.T, tree *LSMTree, key, want string) {
+	t.Helper()
+	value, exists, err := tree.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != want || exists != (want != "") {
+		t.Fatalf("%s should be %q, got %q (%v)", key, want, value, exists)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tree := openTestTree(t, &Options{BlockSize: 32})
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := tree.BeginTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, exists, err := txn.Get([]byte("a")); err != nil || !exists || string(value) != "1" {
+		t.Fatalf("transaction should read a as 1, got %s %v %v", value, exists, err)
+	}
+
+	// The transaction reads its own writes, nobody else sees them before Commit.
+	if err := txn.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if value, exists, err := txn.Get([]byte("a")); err != nil || !exists || string(value) != "2" {
+		t.Fatalf("transaction should read a as 2, got %s %v %v", value, exists, err)
+	}
+	if _, exists, err := txn.Get([]byte("b")); err != nil || exists {
+		t.Fatalf("transaction should read b as deleted, got %v %v", exists, err)
+	}
+	valueShouldBe(t, tree, "a", "1")
+	valueShouldBe(t, tree, "b", "1")
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "2")
+	valueShouldBe(t, tree, "b", "")
+
+	if _, _, err := txn.Get([]byte("a")); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("Get should fail with ErrTxnDone, got %v", err)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("Commit should fail with ErrTxnDone, got %v", err)
+	}
+
+	// Rollback discards the writes.
+	txn, err = tree.BeginTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put([]byte("c"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "c", "")
+
+	tree.mu.RLock()
+	snapshots := len(tree.snapshots)
+	tree.mu.RUnlock()
+	if snapshots != 0 {
+		t.Fatalf("ended transactions should release their snapshots, %d left", snapshots)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	tree := openTestTree(t, &Options{BlockSize: 32})
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// write is the write made by someone else while the transaction runs.
+		write func() error
+		// read is the key read by the transaction.
+		read     string
+		conflict bool
+	}{
+		{"put of a read key", func() error { return tree.Put([]byte("a"), []byte("2")) }, "a", true},
+		{"put of a missing read key", func() error { return tree.Put([]byte("b"), []byte("1")) }, "b", true},
+		{"put of another key", func() error { return tree.Put([]byte("c"), []byte("1")) }, "a", false},
+		{"delete of a compacted read key", func() error {
+			if err := tree.Delete([]byte("a")); err != nil {
+				return err
+			}
+			return tree.CompactRange(nil, nil)
+		}, "a", true},
+	}
+	for _, test := range tests {
+		for _, readOnly := range []bool{false, true} {
+			txn, err := tree.BeginTxn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := txn.Get([]byte(test.read)); err != nil {
+				t.Fatal(err)
+			}
+			if !readOnly {
+				if err := txn.Put([]byte("result"), []byte(test.name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := test.write(); err != nil {
+				t.Fatal(err)
+			}
+
+			err = txn.Commit()
+			if test.conflict {
+				if !errors.Is(err, ErrConflict) {
+					t.Fatalf("%s: Commit should fail with ErrConflict, got %v", test.name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: Commit should succeed, got %v", test.name, err)
+			}
+			if !readOnly {
+				valueShouldBe(t, tree, "result", test.name)
+			}
+		}
+	}
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	tree := openTestTree(t, &Options{MemTableSize: 256, BlockSize: 32})
+	defer tree.Close()
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				txn, err := tree.BeginTxn()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value, _, err := txn.Get([]byte("counter"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count, _ := strconv.Atoi(string(value))
+				if err := txn.Put([]byte("counter"), []byte(strconv.Itoa(count+1))); err != nil {
+					t.Error(err)
+					return
+				}
+				err = txn.Commit()
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n++
+			}
+		}()
+	}
+	wg.Wait()
+
+	valueShouldBe(t, tree, "counter", strconv.Itoa(workers*increments))
+}
+
+func TestPessimisticTxn(t *testing.T) {
+	tree := openTestTree(t, &Options{BlockSize: 32, LockTimeout: 20 * time.Millisecond})
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn1, err := tree.BeginPessimisticTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := txn1.GetForUpdate([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("a should be 1, got %s %v", value, err)
+	}
+	if err := txn1.Put([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys locked by txn1 cannot be locked by txn2 until txn1 ends.
+	txn2, err := tree.BeginPessimisticTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := txn2.GetForUpdate([]byte("a")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("GetForUpdate should fail with ErrLockTimeout, got %v", err)
+	}
+	if err := txn2.Delete([]byte("b")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Delete should fail with ErrLockTimeout, got %v", err)
+	}
+	if err := txn1.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writes of a commit are one WAL record.
+	tree.writeMu.Lock()
+	walWrites := tree.walWrites
+	tree.writeMu.Unlock()
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tree.writeMu.Lock()
+	walWrites = tree.walWrites - walWrites
+	tree.writeMu.Unlock()
+	if walWrites != 1 {
+		t.Fatalf("commit should write the WAL once, got %d", walWrites)
+	}
+
+	// The latest value is read once the lock is taken, not the value as of the start of txn2.
+	if value, _, err := txn2.GetForUpdate([]byte("a")); err != nil || string(value) != "2" {
+		t.Fatalf("a should be 2, got %s %v", value, err)
+	}
+	if err := txn2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "2")
+	valueShouldBe(t, tree, "b", "1")
+}
+
+func TestPessimisticTxnLocksOnlyTxns(t *testing.T) {
+	tree := openTestTree(t, &Options{BlockSize: 32, LockTimeout: 20 * time.Millisecond})
+	defer tree.Close()
+
+	txn, err := tree.BeginPessimisticTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := txn.GetForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes outside of pessimistic transactions do not wait for the lock.
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "1")
+	optimistic, err := tree.BeginTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := optimistic.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := optimistic.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "2")
+
+	// The pessimistic transaction commits without a conflict, its write wins.
+	if err := txn.Put([]byte("a"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "3")
+}
+
+func TestPessimisticTxnConcurrentIncrements(t *testing.T) {
+	tree := openTestTree(t, &Options{MemTableSize: 256, BlockSize: 32, LockTimeout: time.Minute})
+	defer tree.Close()
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; n++ {
+				txn, err := tree.BeginPessimisticTxn()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value, _, err := txn.GetForUpdate([]byte("counter"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count, _ := strconv.Atoi(string(value))
+				if err := txn.Put([]byte("counter"), []byte(strconv.Itoa(count+1))); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := txn.Commit(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	valueShouldBe(t, tree, "counter", strconv.Itoa(workers*increments))
+}
+
+func TestPessimisticTxnDeadlock(t *testing.T) {
+	tree := openTestTree(t, &Options{BlockSize: 32, LockTimeout: time.Minute})
+	defer tree.Close()
+
+	txn1, err := tree.BeginPessimisticTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn2, err := tree.BeginPessimisticTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn1.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn2.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		_, _, err := txn1.GetForUpdate([]byte("b"))
+		locked <- err
+	}()
+	waitForWaiter(tree.locks, txn1.id)
+	if _, _, err := txn2.GetForUpdate([]byte("a")); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("GetForUpdate should fail with ErrDeadlock, got %v", err)
+	}
+	if err := txn2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	valueShouldBe(t, tree, "a", "1")
+	valueShouldBe(t, tree, "b", "")
+}
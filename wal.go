@@ -1,35 +1,272 @@
 package lsmtree
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-func loadWAL(wal *os.File) (*memTable, error) {
+// The WAL is split into numbered segments, one for every memTable.
+// A new segment is started whenever the memTable is frozen and a segment
+// is deleted once its memTable is flushed and recorded in the MANIFEST.
+
+// wal record format:
+// [checksum of payload length and payload, 4 bytes][payload length, 4 bytes][payload]
+//
+// The checksum covers the length so that a corrupted length is detected.
+//
+// payload: a serialized write batch, every write is committed as a batch.
+
+const (
+	// walRecordHeaderSize is the size of the header in front of every WAL record.
+	walRecordHeaderSize = checksumSize + 4
+
+	// maxWALPayloadLen is the largest payload of a WAL record, so the largest write batch.
+	maxWALPayloadLen = 1<<31 - 1
+
+	// walFileNameSuffix is the suffix of the WAL segment files.
+	walFileNameSuffix = ".wal"
+)
+
+// walPath returns the path of the WAL segment for giving segment number.
+func walPath(dir string, number int) string {
+	return path.Join(dir, strconv.Itoa(number)+walFileNameSuffix)
+}
+
+// createWAL creates a new empty WAL segment.
+func createWAL(fs FS, dir string, number int) (File, error) {
+	return fs.Create(walPath(dir, number))
+}
+
+// deleteWAL deletes the WAL segment.
+func deleteWAL(fs FS, dir string, number int) error {
+	return fs.Remove(walPath(dir, number))
+}
+
+// listWALs returns the numbers of the WAL segments in dir, in ascending order.
+func listWALs(fs FS, dir string) ([]int, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for _, name := range names {
+		if !strings.HasSuffix(name, walFileNameSuffix) {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSuffix(name, walFileNameSuffix))
+		if err != nil || number < 0 {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// recoverWALs replays the WAL segments, oldest first, into one memTable each.
+// The last segment is left open for appending and returned along with the memTables.
+// With WALRecoveryPointInTime, the segments after a segment with dropped records are deleted.
+func recoverWALs(fs FS, dir string, numbers []int, mode WALRecoveryMode, logger Logger) ([]*memTable, File, error) {
+	var mts []*memTable
+	for i, number := range numbers {
+		wal, err := fs.OpenReadWrite(walPath(dir, number))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mt, dropped, err := loadWAL(wal, mode, logger)
+		if err != nil {
+			wal.Close()
+			return nil, nil, fmt.Errorf("lsmtree: replaying WAL segment %d: %w", number, err)
+		}
+		mt.walNumber = number
+		mts = append(mts, mt)
+
+		last := i == len(numbers)-1
+		if dropped && mode == WALRecoveryPointInTime && !last {
+			for _, later := range numbers[i+1:] {
+				logger.Printf("lsmtree: dropping WAL segment %d after point in time recovery", later)
+				if err := deleteWAL(fs, dir, later); err != nil {
+					wal.Close()
+					return nil, nil, err
+				}
+			}
+			last = true
+		}
+		if last {
+			return mts, wal, nil
+		}
+		if err := wal.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// loadWAL replays the WAL into a new memTable.
+// Every record is verified, corrupted or truncated records are handled as told by mode.
+// When records are dropped from the end of the WAL, it is truncated to the last good record
+// so that new records are appended right after it, and dropped is true.
+func loadWAL(wal File, mode WALRecoveryMode, logger Logger) (*memTable, bool, error) {
+	info, err := wal.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	end := info.Size()
+
 	mt := newMemTable()
+	r := bufio.NewReader(wal)
+	var offset int64
+	dropped := false
 	for {
-		key, value, err := decode(wal)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
+		payload, size, err := readWALRecord(r, wal.Name(), offset, end)
 		if err == io.EOF {
-			return mt, nil
+			return mt, dropped, nil
 		}
-		err = mt.put(key, value)
+		corruption, ok := err.(*CorruptionError)
+		if err != nil && !ok {
+			return nil, false, err
+		}
+
+		if err == nil {
+			err := applyWriteBatch(mt, payload)
+			if err == nil {
+				offset += size
+				continue
+			}
+			corruption = &CorruptionError{Path: wal.Name(), Offset: offset, Reason: err.Error()}
+		}
+
+		// The corrupted record is the last one if it is torn or ends at the end of the WAL.
+		tail := size < 0 || offset+size == end
+
+		switch {
+		case mode == WALRecoveryAbsoluteConsistency:
+			return nil, false, corruption
+		case mode == WALRecoveryTolerateCorruptedTail && !tail:
+			return nil, false, corruption
+		case mode == WALRecoverySkipCorrupted && size > 0 && !tail:
+			logger.Printf("lsmtree: skipping WAL record: %s", corruption)
+			dropped = true
+			offset += size
+			// The reader may be past the next record when the length was corrupted.
+			if _, err := wal.Seek(offset, io.SeekStart); err != nil {
+				return nil, false, err
+			}
+			r.Reset(wal)
+			continue
+		}
+
+		logger.Printf("lsmtree: dropping WAL records from offset %d: %s", offset, corruption)
+		if err := truncateWAL(wal, offset); err != nil {
+			return nil, false, err
+		}
+		return mt, true, nil
+	}
+}
+
+// readWALRecord reads the payload of the WAL record at offset in the WAL at path and verifies its checksum.
+// end is the size of the WAL. Returns the size of the record, or -1 if the record is torn: cut by the end
+// of the WAL, as a crash during its write leaves it. When the length of the record is corrupted,
+// the size returned reaches the next valid record.
+// Returns io.EOF if there are no more records.
+func readWALRecord(r io.Reader, path string, offset, end int64) ([]byte, int64, error) {
+	header := make([]byte, walRecordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, -1, &CorruptionError{Path: path, Offset: offset, Reason: "truncated record header"}
+		}
+		return nil, -1, err
+	}
+
+	length := binary.BigEndian.Uint32(header[checksumSize:])
+	left := end - offset - walRecordHeaderSize
+	if int64(length) > left {
+		// The record is torn unless its length is corrupted, then valid records follow it.
+		rest, err := ioutil.ReadAll(io.LimitReader(r, left))
 		if err != nil {
-			return nil, err
+			return nil, -1, err
 		}
+		if next := findWALRecord(rest); next >= 0 {
+			return nil, walRecordHeaderSize + int64(next), &CorruptionError{Path: path, Offset: offset, Reason: "record length out of range"}
+		}
+		return nil, -1, &CorruptionError{Path: path, Offset: offset, Reason: "truncated record"}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, -1, &CorruptionError{Path: path, Offset: offset, Reason: "truncated record"}
+		}
+		return nil, -1, err
+	}
+
+	size := int64(walRecordHeaderSize) + int64(length)
+	if binary.BigEndian.Uint32(header) != walChecksum(header[checksumSize:], payload) {
+		return nil, size, &CorruptionError{Path: path, Offset: offset, Reason: "checksum mismatch"}
 	}
+	return payload, size, nil
 }
 
-func appendWAL(wal *os.File, key, value []byte) error {
-	if _, err := encode(wal, key, value); err != nil {
-		return nil
+// findWALRecord returns the offset of the first complete record with a valid checksum in b, -1 if there is none.
+func findWALRecord(b []byte) int {
+	for i := 0; i+walRecordHeaderSize <= len(b); i++ {
+		length := binary.BigEndian.Uint32(b[i+checksumSize:])
+		start := i + walRecordHeaderSize
+		if int64(length) > int64(len(b)-start) {
+			continue
+		}
+		if binary.BigEndian.Uint32(b[i:]) == walChecksum(b[i+checksumSize:start], b[start:start+int(length)]) {
+			return i
+		}
 	}
+	return -1
+}
 
-	if err := wal.Sync(); err != nil {
+// walChecksum returns the checksum of a WAL record, over its encoded length and its payload.
+func walChecksum(length, payload []byte) uint32 {
+	return crc32.Update(checksum(length), crcTable, payload)
+}
+
+// truncateWAL drops everything from offset on and moves the write position there.
+func truncateWAL(wal File, offset int64) error {
+	if err := wal.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := wal.Seek(offset, io.SeekStart); err != nil {
 		return err
 	}
+	return wal.Sync()
+}
+
+// encodeWALRecord appends the WAL record of the payload to buf.
+func encodeWALRecord(buf *bytes.Buffer, payload []byte) {
+	header := make([]byte, walRecordHeaderSize)
+	binary.BigEndian.PutUint32(header[checksumSize:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header, walChecksum(header[checksumSize:], payload))
+	buf.Write(header)
+	buf.Write(payload)
+}
+
+// appendWAL appends encoded WAL records to the WAL in a single write, syncs it if sync is true.
+func appendWAL(wal File, records []byte, sync bool) error {
+	if _, err := wal.Write(records); err != nil {
+		return err
+	}
+
+	if !sync {
+		return nil
+	}
 
-	return nil
+	return wal.Sync()
 }
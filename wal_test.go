@@ -0,0 +1,194 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// appendWALRecord appends a single record to the WAL.
+func appendWALRecord(wal File, key, value []byte, rt recordType, sync bool) error {
+	var batch WriteBatch
+	if rt == recordTypeDelete {
+		batch.Delete(key)
+	} else {
+		batch.Put(key, value)
+	}
+
+	var record bytes.Buffer
+	encodeWALRecord(&record, batch.Data())
+	return appendWAL(wal, record.Bytes(), sync)
+}
+
+// writeWAL writes keyNum records to a new WAL in dir.
+// Returns the offset of every record.
+func writeWAL(t *testing.T, fs FS, dir string, keyNum int) []int64 {
+	wal, err := createWAL(fs, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var offsets []int64
+	var offset int64
+	for i := 0; i < keyNum; i++ {
+		offsets = append(offsets, offset)
+		if err := appendWALRecord(wal, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), recordTypePut, false); err != nil {
+			t.Fatal(err)
+		}
+		info, err := wal.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset = info.Size()
+	}
+	return offsets
+}
+
+// walKeysShouldBe checks that the memTable holds exactly the given keys out of keyNum.
+func walKeysShouldBe(t *testing.T, mt *memTable, keyNum int, keys ...int) {
+	t.Helper()
+	want := make(map[int]bool)
+	for _, i := range keys {
+		want[i] = true
+	}
+	for i := 0; i < keyNum; i++ {
+		_, _, exists := mt.get([]byte(fmt.Sprintf("key%d", i)), maxSequenceNumber)
+		if exists != want[i] {
+			t.Fatalf("key%d should exist: %v, got %v", i, want[i], exists)
+		}
+	}
+}
+
+func TestLoadWALRecovery(t *testing.T) {
+	const keyNum = 5
+	tests := []struct {
+		name string
+		// corrupt returns the damaged content of the WAL, offsets are the offsets of the records.
+		corrupt func(data []byte, offsets []int64) []byte
+		mode    WALRecoveryMode
+		// fails tells whether loadWAL should fail, keys are the keys replayed otherwise
+		// and size the size of the WAL after replay, nil if it should not change.
+		fails bool
+		keys  []int
+		size  func(offsets []int64) int64
+	}{
+		{"torn tail, point in time", tornTail, WALRecoveryPointInTime, false, []int{0, 1, 2, 3}, recordOffset(4)},
+		{"torn tail, tolerate tail", tornTail, WALRecoveryTolerateCorruptedTail, false, []int{0, 1, 2, 3}, recordOffset(4)},
+		{"torn tail, absolute", tornTail, WALRecoveryAbsoluteConsistency, true, nil, nil},
+		{"torn tail, skip", tornTail, WALRecoverySkipCorrupted, false, []int{0, 1, 2, 3}, recordOffset(4)},
+		{"corrupt record, point in time", corruptRecord(2), WALRecoveryPointInTime, false, []int{0, 1}, recordOffset(2)},
+		{"corrupt record, tolerate tail", corruptRecord(2), WALRecoveryTolerateCorruptedTail, true, nil, nil},
+		{"corrupt record, absolute", corruptRecord(2), WALRecoveryAbsoluteConsistency, true, nil, nil},
+		{"corrupt record, skip", corruptRecord(2), WALRecoverySkipCorrupted, false, []int{0, 1, 3, 4}, nil},
+		{"corrupt last record, tolerate tail", corruptRecord(4), WALRecoveryTolerateCorruptedTail, false, []int{0, 1, 2, 3}, recordOffset(4)},
+		{"corrupt length, point in time", corruptLength(2), WALRecoveryPointInTime, false, []int{0, 1}, recordOffset(2)},
+		{"corrupt length, tolerate tail", corruptLength(2), WALRecoveryTolerateCorruptedTail, true, nil, nil},
+		{"corrupt length, absolute", corruptLength(2), WALRecoveryAbsoluteConsistency, true, nil, nil},
+		{"corrupt length, skip", corruptLength(2), WALRecoverySkipCorrupted, false, []int{0, 1, 3, 4}, nil},
+		{"corrupt last length, tolerate tail", corruptLength(4), WALRecoveryTolerateCorruptedTail, false, []int{0, 1, 2, 3}, recordOffset(4)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, dir := NewMemFS(), "."
+			walFile := walPath(dir, 0)
+			offsets := writeWAL(t, fs, dir, keyNum)
+			data := test.corrupt(readFile(t, fs, walFile), offsets)
+			writeFile(t, fs, walFile, data)
+
+			wal, err := fs.OpenReadWrite(walFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+
+			mt, dropped, err := loadWAL(wal, test.mode, discardLogger{})
+			if test.fails {
+				if !errors.Is(err, ErrCorruption) {
+					t.Fatalf("loadWAL should fail with ErrCorruption, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dropped {
+				t.Fatal("loadWAL should report dropped records")
+			}
+			walKeysShouldBe(t, mt, keyNum, test.keys...)
+
+			size := int64(len(data))
+			if test.size != nil {
+				size = test.size(offsets)
+			}
+			after, err := wal.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Size() != size {
+				t.Fatalf("WAL size should be %d after replay, got %d", size, after.Size())
+			}
+
+			// New records are appended after the last good record and replayed on the next load.
+			if err := appendWALRecord(wal, []byte("key9"), []byte("value9"), recordTypePut, true); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wal.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			mt, _, err = loadWAL(wal, test.mode, discardLogger{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			walKeysShouldBe(t, mt, 10, append(test.keys, 9)...)
+		})
+	}
+}
+
+// tornTail cuts the last record in the middle, as a crash during its write would.
+func tornTail(data []byte, offsets []int64) []byte {
+	return data[:len(data)-3]
+}
+
+// corruptRecord returns a corrupt func flipping a bit in the payload of the i-th record.
+func corruptRecord(i int) func(data []byte, offsets []int64) []byte {
+	return func(data []byte, offsets []int64) []byte {
+		data[offsets[i]+walRecordHeaderSize+2] ^= 0x01
+		return data
+	}
+}
+
+// corruptLength returns a corrupt func flipping a bit in the length of the i-th record,
+// so that the record seems to run past the end of the WAL.
+func corruptLength(i int) func(data []byte, offsets []int64) []byte {
+	return func(data []byte, offsets []int64) []byte {
+		data[offsets[i]+checksumSize+2] ^= 0x02
+		return data
+	}
+}
+
+// recordOffset returns a size func returning the offset of the i-th record.
+func recordOffset(i int) func(offsets []int64) int64 {
+	return func(offsets []int64) int64 {
+		return offsets[i]
+	}
+}
+
+func TestWALChecksumCoversLength(t *testing.T) {
+	payload := []byte("payload")
+	var record bytes.Buffer
+	encodeWALRecord(&record, payload)
+	data := record.Bytes()
+	if got, _, err := readWALRecord(bytes.NewReader(data), "wal", 0, int64(len(data))); err != nil || string(got) != string(payload) {
+		t.Fatalf("record should read back as %q, got %q %v", payload, got, err)
+	}
+
+	// A checksum over the payload alone does not match.
+	binary.BigEndian.PutUint32(data, checksum(payload))
+	if _, _, err := readWALRecord(bytes.NewReader(data), "wal", 0, int64(len(data))); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("record checksummed without its length should fail with ErrCorruption, got %v", err)
+	}
+}
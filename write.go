@@ -0,0 +1,171 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxWriteGroupSize is the approximate largest number of bytes of write batches committed together.
+// A larger write batch is still committed, alone.
+const maxWriteGroupSize = 1 << 20
+
+// pendingWrite is a write batch waiting in the write queue.
+type pendingWrite struct {
+	// batch is the serialized write batch.
+	batch []byte
+	// check, if not nil, is called before the batch is committed, after every earlier write.
+	// The batch is not committed if it fails.
+	check func() error
+
+	// done is set once the write is committed by the leader of its group, err is the result.
+	done bool
+	err  error
+	cond *sync.Cond
+}
+
+// Write applies every update of the batch atomically.
+// The batch may be reused once Write returns.
+func (t *LSMTree) Write(batch *WriteBatch) error {
+	return t.write(batch.Data(), nil)
+}
+
+// write appends the serialized write batch to the WAL as one record and applies it to the memTable.
+// Concurrent writes queue up: the write at the head of the queue leads a group made
+// of the writes queued behind it and commits all of them with one WAL write and one sync.
+// A write with a check is committed in a group of its own, so the check sees every earlier write.
+func (t *LSMTree) write(batch []byte, check func() error) error {
+	if len(batch) > maxWALPayloadLen {
+		return fmt.Errorf("lsmtree: write batch of %d bytes is larger than %d bytes", len(batch), maxWALPayloadLen)
+	}
+
+	w := &pendingWrite{batch: batch, check: check, cond: sync.NewCond(&t.writeQueueMu)}
+
+	t.writeQueueMu.Lock()
+	t.writeQueue = append(t.writeQueue, w)
+	for !w.done && t.writeQueue[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		t.writeQueueMu.Unlock()
+		return w.err
+	}
+
+	n, size := 1, len(batch)
+	for ; n < len(t.writeQueue) && check == nil; n++ {
+		size += len(t.writeQueue[n].batch)
+		if size > maxWriteGroupSize || t.writeQueue[n].check != nil {
+			break
+		}
+	}
+	group := t.writeQueue[:n]
+	t.writeQueueMu.Unlock()
+
+	err := t.commitGroup(group)
+
+	t.writeQueueMu.Lock()
+	for _, follower := range group[1:] {
+		follower.err = err
+		follower.done = true
+		follower.cond.Signal()
+	}
+	t.writeQueue = t.writeQueue[n:]
+	if len(t.writeQueue) > 0 {
+		t.writeQueue[0].cond.Signal()
+	}
+	t.writeQueueMu.Unlock()
+
+	return err
+}
+
+// commitGroup assigns the next sequence numbers to the write batches of the group,
+// appends them to the WAL with one write, syncs it as told by the options,
+// then applies the batches to the memTable.
+// mu is held while applying, so readers see either all or none of a batch.
+func (t *LSMTree) commitGroup(group []*pendingWrite) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	if err := t.makeRoomForWrite(); err != nil {
+		return err
+	}
+	// A write with a check is alone in its group.
+	if check := group[0].check; check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	// lastSequence only changes while holding writeMu.
+	seq := t.lastSequence
+	var records bytes.Buffer
+	for _, w := range group {
+		setWriteBatchSequence(w.batch, seq+1)
+		seq += uint64(writeBatchCount(w.batch))
+		encodeWALRecord(&records, w.batch)
+	}
+	if err := appendWAL(t.wal, records.Bytes(), t.opts.Sync == SyncAlways); err != nil {
+		// The WAL may end with part of the records, a record appended after them
+		// would be dropped by recovery. Every later write fails instead.
+		t.mu.Lock()
+		t.opts.Logger.Printf("lsmtree: WAL write failed: %s", err)
+		t.bgErr = err
+		t.bgCond.Broadcast()
+		t.mu.Unlock()
+		return err
+	}
+	t.walWrites++
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range group {
+		if err := applyWriteBatch(t.memTable, w.batch); err != nil {
+			return err
+		}
+	}
+	t.lastSequence = seq
+	return nil
+}
+
+// syncLoop syncs the WAL every SyncPeriod until Close.
+// It stops at the first error, which is then returned to writers.
+func (t *LSMTree) syncLoop() {
+	defer t.syncWG.Done()
+
+	ticker := time.NewTicker(t.opts.SyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.syncStop:
+			return
+		case <-ticker.C:
+		}
+
+		// writeMu keeps freezeMemTable from closing the WAL segment during the sync.
+		// Readers do not wait for the sync, only writers do.
+		t.writeMu.Lock()
+		err := t.wal.Sync()
+		t.writeMu.Unlock()
+
+		if err != nil {
+			t.mu.Lock()
+			t.opts.Logger.Printf("lsmtree: background WAL sync failed: %s", err)
+			t.bgErr = err
+			t.bgCond.Broadcast()
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// stopSync stops the background sync of the WAL and waits for it to return.
+// It must be called without writeMu, which the sync takes.
+func (t *LSMTree) stopSync() {
+	if t.syncStop == nil {
+		return
+	}
+	t.syncStopOnce.Do(func() { close(t.syncStop) })
+	t.syncWG.Wait()
+}
@@ -0,0 +1,318 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the commits so the writes pile up in the queue.
+	tree.writeMu.Lock()
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	for {
+		tree.writeQueueMu.Lock()
+		queued := len(tree.writeQueue)
+		tree.writeQueueMu.Unlock()
+		if queued == writers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tree.writeMu.Unlock()
+	wg.Wait()
+
+	// The first writer leads a group of its own, the others are committed together.
+	tree.writeMu.Lock()
+	walWrites := tree.walWrites
+	tree.writeMu.Unlock()
+	if walWrites != 2 {
+		t.Fatalf("%d writers should be committed with 2 WAL writes, got %d", writers, walWrites)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < writers; i++ {
+		if _, exists, err := tree.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || !exists {
+			t.Fatalf("key%d should exist, got %v %v", i, exists, err)
+		}
+	}
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	for _, test := range []struct {
+		sync SyncMode
+		// survive tells whether the writes survive a crash once a sync period has passed.
+		survive bool
+	}{
+		{SyncPeriodic, true},
+		{SyncNever, false},
+	} {
+		fs := NewMemFS()
+		opts := &Options{BlockSize: 32, Sync: test.sync, SyncPeriod: time.Millisecond, FS: fs}
+		tree, err := Open("db", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		// Close would sync the WAL, the crash happens before.
+		crashed := fs.CrashClone()
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		tree, err = Open("db", &Options{BlockSize: 32, FS: crashed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, exists, err := tree.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || exists != test.survive {
+				t.Fatalf("sync mode %d: key%d should exist: %v, got %v %v", test.sync, i, test.survive, exists, err)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// lastSequenceShouldBe checks the sequence number of the last write of the tree.
+func lastSequenceShouldBe(t *testing.T, tree *LSMTree, want uint64) {
+	t.Helper()
+	tree.mu.RLock()
+	got := tree.lastSequence
+	tree.mu.RUnlock()
+	if got != want {
+		t.Fatalf("last sequence should be %d, got %d", want, got)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	fs, dir := NewMemFS(), "db"
+	tree, err := Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every update of a batch takes its own sequence number.
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.Put([]byte("a"), []byte("2"))
+	batch.Put([]byte("b"), []byte("1"))
+	batch.Delete([]byte("c"))
+	if err := tree.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	lastSequenceShouldBe(t, tree, 4)
+
+	// Both versions of a are kept and written to the disk table, the newest wins.
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countDiskTableEntries(t, tree.fs, dir, tree.levels[0][0].index); count != 4 {
+		t.Fatalf("disk table should hold 4 records, got %d", count)
+	}
+	if value, _, err := tree.Get([]byte("a")); err != nil || string(value) != "2" {
+		t.Fatalf("a should be 2, got %s %v", value, err)
+	}
+
+	// The WAL is empty after the flush, the last sequence comes from the MANIFEST.
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSequenceShouldBe(t, tree, 4)
+	if err := tree.Put([]byte("a"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	lastSequenceShouldBe(t, tree, 5)
+
+	// Unflushed writes are newer than the MANIFEST, the last sequence comes from the WAL.
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = Open(dir, &Options{BlockSize: 32, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	lastSequenceShouldBe(t, tree, 5)
+	if value, _, err := tree.Get([]byte("a")); err != nil || string(value) != "3" {
+		t.Fatalf("a should be 3, got %s %v", value, err)
+	}
+}
+
+// failingWALFS is a FS whose WAL segments write half of the data and fail while failing is set.
+type failingWALFS struct {
+	FS
+	failing int32
+}
+
+func (fs *failingWALFS) Create(name string) (File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil || path.Ext(name) != ".wal" {
+		return f, err
+	}
+	return &failingFile{File: f, fs: fs}, nil
+}
+
+// failingFile is a WAL segment created by a failingWALFS.
+type failingFile struct {
+	File
+	fs *failingWALFS
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&f.fs.failing) == 0 {
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("write failed")
+}
+
+func TestWALWriteFailure(t *testing.T) {
+	for _, recovery := range []WALRecoveryMode{WALRecoveryPointInTime, WALRecoveryTolerateCorruptedTail} {
+		fs := &failingWALFS{FS: NewMemFS()}
+		tree, err := Open("db", &Options{BlockSize: 32, FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&fs.failing, 1)
+		if err := tree.Put([]byte("b"), []byte("1")); err == nil {
+			t.Fatal("Put should fail with the WAL write")
+		}
+
+		// Nothing is appended after the partial record, even once the WAL can be written again.
+		atomic.StoreInt32(&fs.failing, 0)
+		if err := tree.Put([]byte("c"), []byte("1")); err == nil {
+			t.Fatal("Put after a failed WAL write should fail")
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err = Open("db", &Options{BlockSize: 32, FS: fs, WALRecovery: recovery})
+		if err != nil {
+			t.Fatalf("recovery mode %d: %s", recovery, err)
+		}
+		valueShouldBe(t, tree, "a", "1")
+		valueShouldBe(t, tree, "b", "")
+		valueShouldBe(t, tree, "c", "")
+		if err := tree.Put([]byte("d"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// blockingSyncFS is a FS whose WAL segments block in the first Sync until release is closed.
+type blockingSyncFS struct {
+	FS
+	syncing, release chan struct{}
+	once             sync.Once
+}
+
+func (fs *blockingSyncFS) Create(name string) (File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil || path.Ext(name) != ".wal" {
+		return f, err
+	}
+	return &blockingSyncFile{File: f, fs: fs}, nil
+}
+
+// blockingSyncFile is a WAL segment created by a blockingSyncFS.
+type blockingSyncFile struct {
+	File
+	fs *blockingSyncFS
+}
+
+func (f *blockingSyncFile) Sync() error {
+	f.fs.once.Do(func() {
+		close(f.fs.syncing)
+		<-f.fs.release
+	})
+	return f.File.Sync()
+}
+
+func TestSyncPeriodicDoesNotBlockReads(t *testing.T) {
+	fs := &blockingSyncFS{FS: NewMemFS(), syncing: make(chan struct{}), release: make(chan struct{})}
+	tree, err := Open("db", &Options{BlockSize: 32, Sync: SyncPeriodic, SyncPeriod: time.Millisecond, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write waits for the sync, reads do not wait for the write.
+	<-fs.syncing
+	written := make(chan error)
+	go func() {
+		written <- tree.Put([]byte("b"), []byte("1"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	read := make(chan error)
+	go func() {
+		_, _, err := tree.Get([]byte("a"))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get should not wait for the WAL sync")
+	}
+
+	close(fs.release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}